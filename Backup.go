@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A BackupEngine keeps incremental backups of a FileDB in a backup directory:
+files/ holds every backed up file once, as an object named after the sha256 of its content
+(not to be confused with the blob files of large values), and meta/ holds one <id>.json per
+backup listing the files of every column family with their hash and key range.
+Since SST and blob files are immutable a new backup only copies the files no earlier backup holds,
+and the hashes of files already backed up are reused instead of being recomputed.
+Restores check the sha256 of every file they copy. Files are written to a temporary name
+and renamed, and a backup only exists once its metadata is written, so an interrupted
+backup leaves at most unreferenced files that the next purge removes.
+The backup directory lives on the VFS of the engine and restores are written there too,
+while the files of a database are read through the VFS of the database.
+Backups of an encrypted database need an engine opened with its KeyProvider, which seals
+the metadata of every backup, as the manifest is sealed, and encrypts the manifest of every
+restored database with the active key.
+CreateBackup, RestoreBackup and PurgeOldBackups run one at a time: the calls of an engine
+wait for each other, and the LOCK file of the backup directory makes those of another engine
+or process fail with ErrBackupLocked, so a purge never removes the files of a backup in progress.
+*/
+
+var ErrBackupNotFound = errors.New("Backup not found")
+
+var ErrBackupLocked = errors.New("Backup directory is in use by another engine")
+
+var backupMagicEncrypted = []byte("LENTABKE")
+
+type BackupEngine struct {
+	directory string
+	fs        VFS
+	keys      KeyProvider // nil for unencrypted databases
+	mu        sync.Mutex
+}
+
+type BackupInfo struct {
+	ID       int            `json:"id"`
+	Time     time.Time      `json:"time"`
+	Size     int64          `json:"size"`     // bytes of all the files of the backup
+	NewBytes int64          `json:"newBytes"` // bytes copied by this backup
+	Files    int            `json:"files"`
+	Sequence uint64         `json:"sequence"`      // sequence number of the last write the SST files hold
+	WAL      string         `json:"wal,omitempty"` // hash of the WAL, if it held anything
+	Families []BackupFamily `json:"families"`
+}
+
+type BackupFamily struct {
+	Name    string              `json:"name"`
+	Options ColumnFamilyOptions `json:"options"`
+	Files   []BackupFile        `json:"files"`
+	Blobs   []BackupBlob        `json:"blobs,omitempty"`
+}
+
+type BackupFile struct {
+	Meta    *fileMeta `json:"meta"`
+	Hash    string    `json:"hash"`
+	ModTime time.Time `json:"modTime"`
+}
+
+type BackupBlob struct {
+	Meta *blobMeta `json:"meta"`
+	Hash string    `json:"hash"`
+}
+
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	return OpenBackupEngineWithFS(dir, OSFS{})
+}
+
+// OpenBackupEngineWithFS opens a backup directory of fs.
+func OpenBackupEngineWithFS(dir string, fs VFS) (*BackupEngine, error) {
+	return OpenBackupEngineWithKeys(dir, fs, nil)
+}
+
+// OpenBackupEngineWithKeys opens a backup directory of fs for databases encrypted with keys.
+func OpenBackupEngineWithKeys(dir string, fs VFS, keys KeyProvider) (*BackupEngine, error) {
+	for _, sub := range []string{"files", "meta"} {
+		if err := fs.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &BackupEngine{directory: dir, fs: fs, keys: keys}, nil
+}
+
+// lock takes the backup directory for one operation, release gives it back.
+func (e *BackupEngine) lock() (release func(), err error) {
+	e.mu.Lock()
+	unlock, locked, err := e.fs.Lock(filepath.Join(e.directory, "LOCK"))
+	if err == nil && !locked {
+		err = ErrBackupLocked
+	}
+	if err != nil {
+		e.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock.Close()
+		e.mu.Unlock()
+	}, nil
+}
+
+func (e *BackupEngine) objectPath(hash string) string {
+	return filepath.Join(e.directory, "files", hash)
+}
+
+func (e *BackupEngine) metaPath(id int) string {
+	return filepath.Join(e.directory, "meta", strconv.Itoa(id)+".json")
+}
+
+// liveFile is a file of the database kept open while it is backed up, so a compaction
+// removing it in the meantime does not matter.
+type liveFile struct {
+	family string
+	meta   *fileMeta
+	blob   *blobMeta // set instead of meta for blob files
+	file   File
+	info   os.FileInfo
+}
+
+// snapshot flushes the database and opens every live file along with the WAL.
+func (fl *FileDB) snapshot() (*Manifest, []liveFile, File, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.closed {
+		return nil, nil, nil, ErrClosed
+	}
+	if !fl.readOnly {
+		if err := fl.flush(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	var files []liveFile
+	closeAll := func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}
+	manifest := fl.manifest()
+	for _, fm := range manifest.Families {
+		cf := fl.families[fm.Name]
+		live := make([]liveFile, 0, len(fm.Files)+len(fm.Blobs))
+		for _, meta := range fm.Files {
+			live = append(live, liveFile{family: fm.Name, meta: meta})
+		}
+		for _, meta := range fm.Blobs {
+			live = append(live, liveFile{family: fm.Name, blob: meta})
+		}
+		for _, f := range live {
+			var path string
+			if f.blob != nil {
+				path = cf.FileManager.blobPath(f.blob.Number)
+			} else {
+				path = cf.FileManager.path(f.meta)
+			}
+			file, err := fl.options.vfs().Open(path)
+			if err != nil {
+				closeAll()
+				return nil, nil, nil, err
+			}
+			f.info, err = file.Stat()
+			if err != nil {
+				file.Close()
+				closeAll()
+				return nil, nil, nil, err
+			}
+			f.file = file
+			files = append(files, f)
+		}
+	}
+	wal, err := fl.options.vfs().Open(fl.FileManager.logPath())
+	if err != nil && !os.IsNotExist(err) {
+		closeAll()
+		return nil, nil, nil, err
+	}
+	return manifest, files, wal, nil
+}
+
+// CreateBackup backs up the current content of db. The database is only locked while its
+// MemTables are flushed and its files opened.
+func (e *BackupEngine) CreateBackup(db *FileDB) (*BackupInfo, error) {
+	release, err := e.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if db.options.KeyProvider != nil && e.keys == nil {
+		return nil, fmt.Errorf("%w: backups of an encrypted database need an engine with its key provider", ErrMissingKey)
+	}
+	backups, err := e.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+	// hashes of the files earlier backups hold, SST names are never reused
+	known := make(map[string]string)
+	for _, b := range backups {
+		for _, family := range b.Families {
+			for _, f := range family.Files {
+				known[family.Name+"/"+f.Meta.Name+"/"+strconv.FormatInt(f.Meta.Size, 10)] = f.Hash
+			}
+			for _, blob := range family.Blobs {
+				known[family.Name+"/"+blob.Meta.name()+"/"+strconv.FormatInt(blob.Meta.Size, 10)] = blob.Hash
+			}
+		}
+	}
+	manifest, files, wal, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+		if wal != nil {
+			wal.Close()
+		}
+	}()
+
+	info := &BackupInfo{ID: 1, Time: time.Now(), Sequence: manifest.LastSequence}
+	if len(backups) > 0 {
+		info.ID = backups[len(backups)-1].ID + 1
+	}
+	families := make(map[string]*BackupFamily)
+	for _, fm := range manifest.Families {
+		info.Families = append(info.Families, BackupFamily{Name: fm.Name, Options: fm.Options, Files: []BackupFile{}})
+	}
+	for i := range info.Families {
+		families[info.Families[i].Name] = &info.Families[i]
+	}
+	for _, f := range files {
+		hash, ok := known[f.family+"/"+f.info.Name()+"/"+strconv.FormatInt(f.info.Size(), 10)]
+		if !ok || !e.hasObject(hash) {
+			var copied int64
+			hash, copied, err = e.storeObject(f.file)
+			if err != nil {
+				return nil, err
+			}
+			info.NewBytes += copied
+		}
+		family := families[f.family]
+		if f.blob != nil {
+			family.Blobs = append(family.Blobs, BackupBlob{Meta: f.blob, Hash: hash})
+		} else {
+			family.Files = append(family.Files, BackupFile{Meta: f.meta, Hash: hash, ModTime: f.info.ModTime()})
+		}
+		info.Size += f.info.Size()
+		info.Files++
+	}
+	if wal != nil {
+		if stat, err := wal.Stat(); err == nil && stat.Size() > int64(len(walMagic)) {
+			hash, copied, err := e.storeObject(wal)
+			if err != nil {
+				return nil, err
+			}
+			info.WAL = hash
+			info.NewBytes += copied
+		}
+	}
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if content, err = sealContent(content, backupMagicEncrypted, e.keys); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(e.fs, e.metaPath(info.ID), content); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (e *BackupEngine) hasObject(hash string) bool {
+	_, err := e.fs.Stat(e.objectPath(hash))
+	return err == nil
+}
+
+// storeObject copies the content of file into files/ unless an identical file is already
+// there. It returns the hash of the content and the number of bytes copied.
+func (e *BackupEngine) storeObject(file File) (string, int64, error) {
+	tmp, err := e.createTemp()
+	if err != nil {
+		return "", 0, err
+	}
+	defer e.fs.Remove(tmp.Name())
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hasher), io.NewSectionReader(file, 0, 1<<62))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if e.hasObject(hash) {
+		return hash, 0, nil
+	}
+	if err := e.fs.Rename(tmp.Name(), e.objectPath(hash)); err != nil {
+		return "", 0, err
+	}
+	return hash, n, nil
+}
+
+// createTemp creates a new temporary file in files/.
+func (e *BackupEngine) createTemp() (File, error) {
+	for {
+		name := filepath.Join(e.directory, "files", "tmp-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+		file, err := e.fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+}
+
+// ListBackups returns every backup, oldest first.
+func (e *BackupEngine) ListBackups() ([]BackupInfo, error) {
+	entries, err := e.fs.ReadDir(filepath.Join(e.directory, "meta"))
+	if err != nil {
+		return nil, err
+	}
+	var backups []BackupInfo
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := e.backup(id)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, *info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ID < backups[j].ID
+	})
+	return backups, nil
+}
+
+func (e *BackupEngine) backup(id int) (*BackupInfo, error) {
+	content, err := readFile(e.fs, e.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %d", ErrBackupNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if content, err = openContent(content, backupMagicEncrypted, e.keys); err != nil {
+		return nil, fmt.Errorf("Backup %d: %w", id, err)
+	}
+	info := &BackupInfo{}
+	if err := json.Unmarshal(content, info); err != nil {
+		return nil, fmt.Errorf("Error parsing backup %d: %v", id, err)
+	}
+	return info, nil
+}
+
+// RestoreBackup writes backup id into dir, which must not exist yet, as a standalone database.
+func (e *BackupEngine) RestoreBackup(id int, dir string) error {
+	release, err := e.lock()
+	if err != nil {
+		return err
+	}
+	defer release()
+	info, err := e.backup(id)
+	if err != nil {
+		return err
+	}
+	if _, err := e.fs.Stat(dir); err == nil {
+		return fmt.Errorf("Restore directory already exists: %s", dir)
+	}
+	tmp := dir + ".tmp"
+	if err := e.fs.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := e.restore(info, tmp); err != nil {
+		e.fs.RemoveAll(tmp)
+		return err
+	}
+	if err := e.fs.Rename(tmp, dir); err != nil {
+		e.fs.RemoveAll(tmp)
+		return err
+	}
+	return e.fs.SyncDir(filepath.Dir(dir))
+}
+
+func (e *BackupEngine) restore(info *BackupInfo, dir string) error {
+	manifest := &Manifest{LastSequence: info.Sequence}
+	for _, family := range info.Families {
+		target := familyDirectory(dir, family.Name)
+		if err := e.fs.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		files := []*fileMeta{}
+		for _, f := range family.Files {
+			path := filepath.Join(target, f.Meta.Name)
+			if err := e.restoreObject(f.Hash, path); err != nil {
+				return err
+			}
+			if err := e.fs.Chtimes(path, f.ModTime, f.ModTime); err != nil {
+				return err
+			}
+			files = append(files, f.Meta)
+		}
+		var blobs []*blobMeta
+		for _, b := range family.Blobs {
+			if err := e.restoreObject(b.Hash, filepath.Join(target, b.Meta.name())); err != nil {
+				return err
+			}
+			blobs = append(blobs, b.Meta)
+		}
+		if err := e.fs.SyncDir(target); err != nil {
+			return err
+		}
+		manifest.Families = append(manifest.Families, familyManifest{Name: family.Name, Options: family.Options, Files: files, Blobs: blobs})
+	}
+	walPath := (&FileManager{directory: dir}).logPath()
+	if info.WAL != "" {
+		if err := e.restoreObject(info.WAL, walPath); err != nil {
+			return err
+		}
+	}
+	return manifest.save(e.fs, dir, e.keys)
+}
+
+// restoreObject copies a backed up file to path, checking its sha256 on the way.
+func (e *BackupEngine) restoreObject(hash, path string) error {
+	in, err := e.fs.Open(e.objectPath(hash))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := e.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hasher), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != hash {
+		return fmt.Errorf("%w: backup file %s does not match its checksum", ErrCorruption, hash)
+	}
+	return nil
+}
+
+// PurgeOldBackups deletes every backup but the keep newest ones, and the files only they held.
+func (e *BackupEngine) PurgeOldBackups(keep int) error {
+	if keep < 0 {
+		return errors.New("keep cannot be negative")
+	}
+	release, err := e.lock()
+	if err != nil {
+		return err
+	}
+	defer release()
+	backups, err := e.ListBackups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := e.fs.Remove(e.metaPath(backups[0].ID)); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	used := make(map[string]bool)
+	for _, b := range backups {
+		used[b.WAL] = true
+		for _, family := range b.Families {
+			for _, f := range family.Files {
+				used[f.Hash] = true
+			}
+			for _, b := range family.Blobs {
+				used[b.Hash] = true
+			}
+		}
+	}
+	entries, err := e.fs.ReadDir(filepath.Join(e.directory, "files"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			if err := e.fs.Remove(e.objectPath(entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
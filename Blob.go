@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Values of at least BlobThreshold bytes are kept out of the SST files: flushes and compactions
+append them to a blob file of the column family (<number>.blob) and the SST record, of type
+blobEntryType, only holds a blobPointer to them: blob file number, offset, length and CRC32C
+of the value. Compactions then move 24 byte pointers instead of whole values.
+A blob file starts with blobMagic followed by records: uvarint key length | key |
+uvarint value length | value. The key is only kept for inspection and repair.
+Blob files are immutable and registered in the manifest with the bytes of values they hold.
+Every compaction merges all the files of the family, so it knows exactly which values are
+still referenced: the others are recorded as garbage, a blob file whose garbage reaches
+BlobGCRatio has its live values copied into the blob file of the compaction, and blob files
+no SST refers to anymore are removed once the new manifest is saved. A family that does not
+compact (CompactionTrigger 0) sweeps its blob files on Open instead, removing those no live
+entry refers to. A sweep merges all its SST files like a compaction, so later flushes only
+sweep again once the family holds twice as many SST files as at the last sweep, which keeps
+the cost of sweeping proportional to what is flushed.
+*/
+
+var blobMagic = []byte("LENTABLB")
+
+const blobEntryType = 2
+
+const blobPointerSize = 24
+
+type blobPointer struct {
+	file     uint64
+	offset   uint64
+	length   uint32
+	checksum uint32
+}
+
+func (p blobPointer) encode() string {
+	buf := make([]byte, blobPointerSize)
+	binary.BigEndian.PutUint64(buf, p.file)
+	binary.BigEndian.PutUint64(buf[8:], p.offset)
+	binary.BigEndian.PutUint32(buf[16:], p.length)
+	binary.BigEndian.PutUint32(buf[20:], p.checksum)
+	return string(buf)
+}
+
+func decodeBlobPointer(s string) (blobPointer, error) {
+	if len(s) != blobPointerSize {
+		return blobPointer{}, fmt.Errorf("%w: invalid blob pointer", ErrCorruption)
+	}
+	buf := []byte(s)
+	return blobPointer{
+		file:     binary.BigEndian.Uint64(buf),
+		offset:   binary.BigEndian.Uint64(buf[8:]),
+		length:   binary.BigEndian.Uint32(buf[16:]),
+		checksum: binary.BigEndian.Uint32(buf[20:]),
+	}, nil
+}
+
+// blobMeta describes a registered blob file.
+type blobMeta struct {
+	Number  uint64 `json:"number"`
+	Size    int64  `json:"size"`    // bytes of the file
+	Values  int64  `json:"values"`  // bytes of the values it holds
+	Garbage int64  `json:"garbage"` // bytes of values no SST refers to anymore, as of the last compaction
+}
+
+func (m *blobMeta) name() string {
+	return strconv.FormatUint(m.Number, 10) + ".blob"
+}
+
+func (f *FileManager) blobPath(number uint64) string {
+	return filepath.Join(f.directory, strconv.FormatUint(number, 10)+".blob")
+}
+
+// blobWriter appends values to a new blob file, opened on the first value.
+type blobWriter struct {
+	f      *FileManager
+	file   File
+	out    *bufio.Writer
+	meta   *blobMeta
+	offset int64
+}
+
+func (f *FileManager) newBlobWriter() *blobWriter {
+	return &blobWriter{f: f}
+}
+
+func (w *blobWriter) add(key, value string) (blobPointer, error) {
+	if w.file == nil {
+		w.meta = &blobMeta{Number: w.f.nextFileNumber()}
+		file, err := w.f.fs.OpenFile(w.f.blobPath(w.meta.Number), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			fmt.Println("Error creating blob file")
+			return blobPointer{}, err
+		}
+		w.file = file
+		w.out = bufio.NewWriter(file)
+		if _, err := w.out.Write(blobMagic); err != nil {
+			return blobPointer{}, err
+		}
+		w.offset = int64(len(blobMagic))
+	}
+	header := binary.AppendUvarint(nil, uint64(len(key)))
+	header = append(header, key...)
+	header = binary.AppendUvarint(header, uint64(len(value)))
+	if _, err := w.out.Write(header); err != nil {
+		return blobPointer{}, err
+	}
+	if _, err := w.out.WriteString(value); err != nil {
+		return blobPointer{}, err
+	}
+	p := blobPointer{
+		file:     w.meta.Number,
+		offset:   uint64(w.offset + int64(len(header))),
+		length:   uint32(len(value)),
+		checksum: crc32.Checksum([]byte(value), castagnoli),
+	}
+	w.offset += int64(len(header) + len(value))
+	w.meta.Values += int64(len(value))
+	return p, nil
+}
+
+// separate moves the value of a put of at least BlobThreshold bytes to the blob file.
+func (w *blobWriter) separate(e Entry) (Entry, error) {
+	if e.t != 0 || w.f.BlobThreshold <= 0 || len(e.Value) < w.f.BlobThreshold {
+		return e, nil
+	}
+	p, err := w.add(e.Key, e.Value)
+	if err != nil {
+		return e, err
+	}
+	return Entry{Key: e.Key, Value: p.encode(), t: blobEntryType}, nil
+}
+
+// finish syncs and closes the blob file, it returns nil when no value was written.
+func (w *blobWriter) finish() (*blobMeta, error) {
+	if w.file == nil {
+		return nil, nil
+	}
+	if err := w.out.Flush(); err != nil {
+		return nil, err
+	}
+	if w.f.SyncMode != SyncNone {
+		if err := w.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.file.Close(); err != nil {
+		return nil, err
+	}
+	w.file = nil
+	w.meta.Size = w.offset
+	if err := w.f.syncDirectory(); err != nil {
+		return nil, err
+	}
+	return w.meta, nil
+}
+
+// abort removes the blob file, it has not been registered.
+func (w *blobWriter) abort() {
+	if w.meta == nil {
+		return
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.f.fs.Remove(w.f.blobPath(w.meta.Number))
+}
+
+// readBlob reads the value a pointer refers to, checking its CRC32C unless ro says otherwise.
+func (f *FileManager) readBlob(pointer string, ro *ReadOptions) (string, error) {
+	if ro == nil {
+		ro = DefaultReadOptions()
+	}
+	p, err := decodeBlobPointer(pointer)
+	if err != nil {
+		return "", err
+	}
+	file, err := f.fs.Open(f.blobPath(p.file))
+	if err != nil {
+		return "", fmt.Errorf("Error opening blob file %d: %w", p.file, err)
+	}
+	defer file.Close()
+	return readBlobValue(file, p, ro)
+}
+
+// readBlobValue reads the value p refers to from its open blob file.
+func readBlobValue(file File, p blobPointer, ro *ReadOptions) (string, error) {
+	value := make([]byte, p.length)
+	if _, err := file.ReadAt(value, int64(p.offset)); err != nil {
+		if err == io.EOF {
+			return "", fmt.Errorf("%w: blob file %d is truncated", ErrCorruption, p.file)
+		}
+		return "", err
+	}
+	if ro.VerifyChecksums && crc32.Checksum(value, castagnoli) != p.checksum {
+		return "", fmt.Errorf("%w: checksum mismatch in blob file %d at offset %d", ErrCorruption, p.file, p.offset)
+	}
+	return string(value), nil
+}
+
+// resolve replaces the pointer of a blob entry with the value it refers to.
+func (f *FileManager) resolve(e Entry, ro *ReadOptions) (Entry, error) {
+	if e.t != blobEntryType {
+		return e, nil
+	}
+	value, err := f.readBlob(e.Value, ro)
+	if err != nil {
+		return e, err
+	}
+	return Entry{Key: e.Key, Value: value}, nil
+}
+
+// loadBlobs registers the blob files listed in the manifest and removes the ones left behind
+// by an interrupted flush or compaction.
+func (f *FileManager) loadBlobs(registered []*blobMeta) error {
+	f.blobs = append([]*blobMeta{}, registered...)
+	known := make(map[string]bool)
+	for _, meta := range f.blobs {
+		known[meta.name()] = true
+		f.noteFileNumber(meta.name())
+	}
+	if f.readOnly {
+		return nil
+	}
+	entries, err := f.fs.ReadDir(f.directory)
+	if err != nil {
+		return errors.New("Error reading directory")
+	}
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".blob" && !known[e.Name()] {
+			fmt.Println("Removing unregistered blob file", e.Name())
+			f.fs.Remove(filepath.Join(f.directory, e.Name()))
+		}
+	}
+	return nil
+}
+
+// adoptBlobs registers every blob file of the directory, used by repair. Their garbage is
+// unknown until the next compaction.
+func (f *FileManager) adoptBlobs() ([]*blobMeta, error) {
+	entries, err := f.fs.ReadDir(f.directory)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []*blobMeta
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".blob" {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".blob"), 10, 64)
+		if err != nil {
+			continue
+		}
+		f.noteFileNumber(e.Name())
+		size := e.Size()
+		blobs = append(blobs, &blobMeta{Number: number, Size: size, Values: size - int64(len(blobMagic))})
+	}
+	return blobs, nil
+}
+
+// removeBlobs deletes blob files that are no longer registered.
+func (f *FileManager) removeBlobs(metas []*blobMeta) {
+	for _, meta := range metas {
+		if err := f.fs.Remove(f.blobPath(meta.Number)); err != nil {
+			fmt.Println("Error removing blob file", meta.name())
+		}
+	}
+}
+
+// collectBlobGarbage updates the garbage of every blob file from the pointers of live, the
+// entries a compaction keeps, and of mem, and returns the blob files whose live values must
+// be copied and those referenced at all. Files mem refers to are never copied: its pointers
+// would be left dangling.
+func (f *FileManager) collectBlobGarbage(live, mem map[string]Entry) (map[uint64]bool, map[uint64]bool, error) {
+	used := make(map[uint64]int64)
+	referenced := make(map[uint64]bool)
+	pinned := make(map[uint64]bool)
+	count := func(entries map[string]Entry, pin bool) error {
+		for _, e := range entries {
+			if e.t != blobEntryType {
+				continue
+			}
+			p, err := decodeBlobPointer(e.Value)
+			if err != nil {
+				return err
+			}
+			used[p.file] += int64(p.length)
+			referenced[p.file] = true
+			pinned[p.file] = pinned[p.file] || pin
+		}
+		return nil
+	}
+	if err := count(live, false); err != nil {
+		return nil, nil, err
+	}
+	if err := count(mem, true); err != nil {
+		return nil, nil, err
+	}
+	relocate := make(map[uint64]bool)
+	for _, meta := range f.blobs {
+		meta.Garbage = max(meta.Values-used[meta.Number], 0)
+		if used[meta.Number] > 0 && !pinned[meta.Number] && f.BlobGCRatio > 0 && float64(meta.Garbage) >= f.BlobGCRatio*float64(meta.Values) {
+			relocate[meta.Number] = true
+		}
+	}
+	return relocate, referenced, nil
+}
+
+// sweepBlobs returns the blob files no live entry refers to anymore, for a family that does
+// not compact: its flushes and Open call it instead, and the caller unregisters them. The SST
+// files keep the records that were overwritten or deleted, so only the newest record of each
+// key counts; the older ones are never read again, and left dangling. Blob files whose values
+// are only partly garbage are kept until a compaction rewrites them.
+func (f *FileManager) sweepBlobs(mem *MemTable) ([]*blobMeta, error) {
+	if f.CompactionTrigger > 0 || len(f.blobs) == 0 || f.readOnly || len(f.files) < 2*f.sweptFiles {
+		return nil, nil
+	}
+	f.sweptFiles = len(f.files)
+	live, _, err := f.liveEntries()
+	if err != nil {
+		return nil, err
+	}
+	_, referenced, err := f.collectBlobGarbage(live, mem.Memdata)
+	if err != nil {
+		return nil, err
+	}
+	var dead []*blobMeta
+	for _, meta := range f.blobs {
+		if !referenced[meta.Number] {
+			dead = append(dead, meta)
+		}
+	}
+	return dead, nil
+}
+
+// unregisterBlobs drops metas from the registered blob files.
+func (f *FileManager) unregisterBlobs(metas []*blobMeta) {
+	removed := make(map[*blobMeta]bool)
+	for _, meta := range metas {
+		removed[meta] = true
+	}
+	var kept []*blobMeta
+	for _, meta := range f.blobs {
+		if !removed[meta] {
+			kept = append(kept, meta)
+		}
+	}
+	f.blobs = kept
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+/*
+Since SST version 4 the records of a data block are prefix compressed: every key is stored
+as the length of the prefix it shares with the previous key followed by the rest of it.
+Every restartInterval records the key is stored in full, and the offsets of these restart
+points end the block so a lookup can binary search them and decode a single run of records.
+
+record  = type | uvarint shared | uvarint unshared | uvarint value length | key suffix | value
+block   = records | restart offsets (uint32 each) | restart count (uint32)
+*/
+
+const defaultRestartInterval = 16
+
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	interval int
+	counter  int
+	lastKey  []byte
+}
+
+func newBlockBuilder(interval int) *blockBuilder {
+	if interval <= 0 {
+		interval = defaultRestartInterval
+	}
+	return &blockBuilder{interval: interval}
+}
+
+// add appends e, keys must be added in increasing order.
+func (b *blockBuilder) add(e Entry) {
+	key := []byte(e.Key)
+	shared := 0
+	if b.counter%b.interval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+	b.buf = append(b.buf, byte(e.t))
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(e.Value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, e.Value...)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.counter == 0
+}
+
+// estimatedSize is the size of the block if it was finished now.
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish returns the encoded block, it is only valid until the next reset.
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.BigEndian.AppendUint32(b.buf, r)
+	}
+	return binary.BigEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func (b *blockBuilder) reset() {
+	b.buf, b.restarts, b.counter, b.lastKey = b.buf[:0], b.restarts[:0], 0, b.lastKey[:0]
+}
+
+// prefixBlock gives access to the records and restart points of an encoded block.
+type prefixBlock struct {
+	data     []byte // the records
+	restarts []byte
+}
+
+func parsePrefixBlock(block []byte) (prefixBlock, error) {
+	if len(block) < 4 {
+		return prefixBlock{}, errors.New("Invalid SST block trailer")
+	}
+	count := int(binary.BigEndian.Uint32(block[len(block)-4:]))
+	end := len(block) - 4 - 4*count
+	if count < 0 || end < 0 {
+		return prefixBlock{}, errors.New("Invalid SST block trailer")
+	}
+	return prefixBlock{data: block[:end], restarts: block[end : len(block)-4]}, nil
+}
+
+func (p prefixBlock) restart(i int) int {
+	return int(binary.BigEndian.Uint32(p.restarts[4*i:]))
+}
+
+// next decodes the record at offset, prev is the key of the previous record.
+func (p prefixBlock) next(offset int, prev []byte) (Entry, []byte, int, error) {
+	invalid := errors.New("Invalid record in SST block")
+	if offset >= len(p.data) {
+		return Entry{}, nil, 0, invalid
+	}
+	t := int(p.data[offset])
+	pos := offset + 1
+	var lengths [3]uint64
+	for i := range lengths {
+		v, n := binary.Uvarint(p.data[pos:])
+		if n <= 0 {
+			return Entry{}, nil, 0, invalid
+		}
+		lengths[i] = v
+		pos += n
+	}
+	shared, unshared, valueLen := lengths[0], lengths[1], lengths[2]
+	if shared > uint64(len(prev)) || unshared > uint64(len(p.data)-pos) || valueLen > uint64(len(p.data)-pos)-unshared {
+		return Entry{}, nil, 0, invalid
+	}
+	key := append(append(make([]byte, 0, shared+unshared), prev[:shared]...), p.data[pos:pos+int(unshared)]...)
+	pos += int(unshared)
+	value := string(p.data[pos : pos+int(valueLen)])
+	return Entry{Key: string(key), Value: value, t: t}, key, pos + int(valueLen), nil
+}
+
+// decodePrefixBlock decodes every record of a block.
+func decodePrefixBlock(block []byte) ([]Entry, error) {
+	p, err := parsePrefixBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	var key []byte
+	for offset := 0; offset < len(p.data); {
+		var e Entry
+		e, key, offset, err = p.next(offset, key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// seekPrefixBlock looks key up without decoding the whole block: it binary searches the
+// restart points for the last one at or before key and scans the records from there.
+func seekPrefixBlock(block []byte, key []byte) (Entry, bool, error) {
+	p, err := parsePrefixBlock(block)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	count := len(p.restarts) / 4
+	var searchErr error
+	i := sort.Search(count, func(i int) bool {
+		_, k, _, err := p.next(p.restart(i), nil)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return bytes.Compare(k, key) > 0
+	})
+	if searchErr != nil {
+		return Entry{}, false, searchErr
+	}
+	if i == 0 {
+		return Entry{}, false, nil
+	}
+	var k []byte
+	for offset := p.restart(i - 1); offset < len(p.data); {
+		var e Entry
+		e, k, offset, err = p.next(offset, k)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		switch bytes.Compare(k, key) {
+		case 0:
+			return e, true, nil
+		case 1:
+			return Entry{}, false, nil
+		}
+	}
+	return Entry{}, false, nil
+}
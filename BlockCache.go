@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+The BlockCache keeps decoded SST data blocks in memory, shared by every file of a FileDB.
+It is bounded in bytes and split into shards, each with its own lock and LRU list, so
+concurrent readers rarely contend. Blocks are identified by the id the cache hands out to
+every opened sstReader and by their offset in the file.
+A capacity of 0 disables the cache.
+*/
+
+const blockCacheShards = 16
+
+type BlockCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Inserts   int64
+	Evictions int64
+	Usage     int64
+	Capacity  int64
+}
+
+// HitRatio is the fraction of lookups served from memory.
+func (s BlockCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type blockKey struct {
+	file   uint64
+	offset int64
+}
+
+type cachedBlock struct {
+	key     blockKey
+	entries []Entry
+	charge  int64
+}
+
+type blockCacheShard struct {
+	capacity int64
+	usage    int64
+	lru      *list.List
+	entries  map[blockKey]*list.Element
+	mu       sync.Mutex
+}
+
+type BlockCache struct {
+	capacity  int64
+	shards    [blockCacheShards]blockCacheShard
+	nextID    uint64
+	hits      int64
+	misses    int64
+	inserts   int64
+	evictions int64
+}
+
+func NewBlockCache(capacity int64) *BlockCache {
+	c := &BlockCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / blockCacheShards
+		c.shards[i].lru = list.New()
+		c.shards[i].entries = make(map[blockKey]*list.Element)
+	}
+	return c
+}
+
+// newID returns the identifier of a newly opened file.
+func (c *BlockCache) newID() uint64 {
+	return atomic.AddUint64(&c.nextID, 1)
+}
+
+func (c *BlockCache) shard(key blockKey) *blockCacheShard {
+	h := key.file*0x9e3779b97f4a7c15 ^ uint64(key.offset)
+	return &c.shards[h%blockCacheShards]
+}
+
+func (c *BlockCache) get(key blockKey) ([]Entry, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(el)
+		atomic.AddInt64(&c.hits, 1)
+		return el.Value.(*cachedBlock).entries, true
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return nil, false
+}
+
+// insert caches a decoded block, charge is its size in bytes.
+func (c *BlockCache) insert(key blockKey, entries []Entry, charge int64) {
+	s := c.shard(key)
+	if charge > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; ok {
+		return
+	}
+	for s.usage+charge > s.capacity && s.lru.Len() > 0 {
+		old := s.lru.Remove(s.lru.Back()).(*cachedBlock)
+		delete(s.entries, old.key)
+		s.usage -= old.charge
+		atomic.AddInt64(&c.evictions, 1)
+	}
+	s.entries[key] = s.lru.PushFront(&cachedBlock{key: key, entries: entries, charge: charge})
+	s.usage += charge
+	atomic.AddInt64(&c.inserts, 1)
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	stats := BlockCacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Inserts:   atomic.LoadInt64(&c.inserts),
+		Evictions: atomic.LoadInt64(&c.evictions),
+		Capacity:  c.capacity,
+	}
+	for i := range c.shards {
+		c.shards[i].mu.Lock()
+		stats.Usage += c.shards[i].usage
+		c.shards[i].mu.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+Checkpoint writes a consistent copy of the database into dir, which must not exist yet,
+while it keeps serving. The MemTables are flushed first (a read-only database copies its WAL
+instead), then every live SST and blob file is hard-linked into dir, or copied when dir is
+on another filesystem, and the manifest and the WAL are written next to them. SST and blob
+files are immutable, so the links share their content safely; dir opens as a standalone
+database. The server only writes checkpoints under Options.CheckpointDir, by name.
+*/
+
+var ErrCheckpointExists = errors.New("Checkpoint directory already exists")
+
+func (fl *FileDB) Checkpoint(dir string) error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.closed {
+		return ErrClosed
+	}
+	fs := fl.options.vfs()
+	if _, err := fs.Stat(dir); err == nil {
+		return fmt.Errorf("%w: %s", ErrCheckpointExists, dir)
+	}
+	if !fl.readOnly {
+		if err := fl.flush(); err != nil {
+			return err
+		}
+	}
+	// build the checkpoint next to its final place so an interrupted one is never mistaken for a
+	// database; a directory left by one is not ours to remove
+	tmp := dir + ".tmp"
+	if err := fs.Mkdir(tmp, 0755); os.IsExist(err) {
+		return fmt.Errorf("%w: %s", ErrCheckpointExists, tmp)
+	} else if err != nil {
+		return err
+	}
+	if err := fl.writeCheckpoint(fs, tmp); err != nil {
+		fs.RemoveAll(tmp)
+		return err
+	}
+	if err := fs.Rename(tmp, dir); err != nil {
+		fs.RemoveAll(tmp)
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(dir))
+}
+
+func (fl *FileDB) writeCheckpoint(fs VFS, dir string) error {
+	for _, name := range sortedFamilyNames(fl.families) {
+		cf := fl.families[name]
+		target := familyDirectory(dir, name)
+		if err := fs.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		for _, meta := range cf.FileManager.files {
+			if err := linkOrCopy(fs, cf.FileManager.path(meta), filepath.Join(target, meta.Name)); err != nil {
+				return err
+			}
+		}
+		for _, meta := range cf.FileManager.blobs {
+			if err := linkOrCopy(fs, cf.FileManager.blobPath(meta.Number), filepath.Join(target, meta.name())); err != nil {
+				return err
+			}
+		}
+		if err := fs.SyncDir(target); err != nil {
+			return err
+		}
+	}
+	if err := copyFile(fs, fl.FileManager.logPath(), filepath.Join(dir, filepath.Base(fl.FileManager.logPath()))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fl.manifest().save(fs, dir, fl.options.KeyProvider)
+}
+
+// linkOrCopy hard-links src to dst, falling back to a copy when they are on different filesystems.
+func linkOrCopy(fs VFS, src, dst string) error {
+	if err := fs.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(fs, src, dst)
+}
+
+// copyFile copies src to dst and syncs it, keeping the modification time used by the TTL.
+func copyFile(fs VFS, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return fs.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// checkpointCommand implements lentadb checkpoint <dir> <target>.
+func checkpointCommand(args []string) int {
+	fs := flag.NewFlagSet("checkpoint", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Println("usage: lentadb checkpoint <dir> <target>")
+		return 2
+	}
+	opts, err := commandOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	db, err := Open(fs.Arg(0), opts)
+	if errors.Is(err, ErrDatabaseLocked) {
+		fmt.Println(err)
+		fmt.Println("The database is in use, ask the server for a checkpoint with POST /admin/checkpoint")
+		return 1
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer db.Close()
+	if err := db.Checkpoint(fs.Arg(1)); err != nil {
+		fmt.Println("Checkpoint failed:", err)
+		return 1
+	}
+	fmt.Println("Checkpoint written to", fs.Arg(1))
+	return 0
+}
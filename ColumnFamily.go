@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+/*
+A ColumnFamily is a named key space inside a FileDB. Every family has its own MemTable,
+its own set of SST files and its own options, while all of them share the database WAL
+so that a WriteBatch touching several families stays atomic.
+The default family lives in the database directory itself, the others in cf/<name>.
+A ColumnFamily implements the DB interface.
+*/
+
+const DefaultColumnFamily = "default"
+
+var ErrColumnFamilyNotFound = errors.New("Column family not found")
+var ErrColumnFamilyExists = errors.New("Column family already exists")
+
+var familyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type ColumnFamilyOptions struct {
+	CacheSize         int           `json:"cache_size"`         // MemTable entries before a flush, 0 uses FileDB.CacheSize
+	CompactionTrigger int           `json:"compaction_trigger"` // number of SST files that triggers a compaction, 0 disables it
+	TTL               time.Duration `json:"ttl"`                // SST files older than TTL are ignored and compacted away, 0 keeps data forever
+}
+
+type ColumnFamily struct {
+	Name        string
+	FileManager *FileManager
+	MemTable    *MemTable
+	Options     ColumnFamilyOptions
+	db          *FileDB
+}
+
+func familyDirectory(root, name string) string {
+	if name == DefaultColumnFamily {
+		return root
+	}
+	return filepath.Join(root, "cf", name)
+}
+
+func validateFamilyName(name string) error {
+	if !familyNamePattern.MatchString(name) {
+		return errors.New("Invalid column family name")
+	}
+	return nil
+}
+
+func newColumnFamily(db *FileDB, name string, f *FileManager, opts ColumnFamilyOptions) *ColumnFamily {
+	f.CompactionTrigger = opts.CompactionTrigger
+	f.TTL = opts.TTL
+	f.tables = db.tables
+	f.keys = db.options.KeyProvider
+	return &ColumnFamily{
+		Name:        name,
+		FileManager: f,
+		MemTable:    &MemTable{Memdata: make(map[string]Entry)},
+		Options:     opts,
+		db:          db,
+	}
+}
+
+func openColumnFamily(db *FileDB, name string, opts ColumnFamilyOptions) (*ColumnFamily, error) {
+	directory := familyDirectory(db.directory, name)
+	if db.readOnly {
+		return newColumnFamily(db, name, readOnlyFileManager(db.options.vfs(), directory), opts), nil
+	}
+	f, err := newFileManager(db.options.vfs(), directory)
+	if err != nil {
+		return nil, err
+	}
+	f.MaxFileSize = db.FileManager.MaxFileSize
+	f.SyncMode = db.FileManager.SyncMode
+	f.BlockSize = db.FileManager.BlockSize
+	f.RestartInterval = db.FileManager.RestartInterval
+	f.Compression = db.FileManager.Compression
+	f.BlobThreshold = db.FileManager.BlobThreshold
+	f.BlobGCRatio = db.FileManager.BlobGCRatio
+	return newColumnFamily(db, name, f, opts), nil
+}
+
+func (cf *ColumnFamily) cacheSize() int {
+	if cf.Options.CacheSize > 0 {
+		return cf.Options.CacheSize
+	}
+	return cf.db.CacheSize
+}
+
+func (cf *ColumnFamily) Set(key, value []byte) error {
+	if cf.db.readOnly {
+		return &ReadOnlyError{Op: "set"}
+	}
+	b := NewWriteBatch()
+	b.Set(cf.Name, key, value)
+	return cf.db.Write(b)
+}
+
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.GetWithOptions(key, nil)
+}
+
+func (cf *ColumnFamily) GetWithOptions(key []byte, ro *ReadOptions) ([]byte, error) {
+	cf.db.mu.Lock()
+	defer cf.db.unlock()
+	if cf.db.closed {
+		return nil, ErrClosed
+	}
+	return cf.db.exists(cf, key, ro)
+}
+
+func (cf *ColumnFamily) Del(key []byte) ([]byte, error) {
+	if cf.db.readOnly {
+		return nil, &ReadOnlyError{Op: "del"}
+	}
+	cf.db.mu.Lock()
+	defer cf.db.unlock()
+	if cf.db.closed {
+		return nil, ErrClosed
+	}
+	v, err := cf.db.exists(cf, key, nil)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	b := NewWriteBatch()
+	b.Del(cf.Name, key)
+	if err := cf.db.write(b); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// scanReadOptions keep large scans out of the block cache.
+var scanReadOptions = &ReadOptions{DontFillCache: true, VerifyChecksums: true}
+
+// Scan calls fn in key order for every live key of the family in [start, end), a nil end
+// meaning no upper bound. It reads the family as it was when it starts, through an Iterator,
+// and does not hold the database lock while fn runs, so fn may use the database.
+func (cf *ColumnFamily) Scan(start, end []byte, fn func(key, value []byte) error) error {
+	it, err := cf.NewIterator(start, end)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for {
+		key, value, err := it.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, nil when there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
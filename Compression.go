@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+A Codec compresses the data blocks of SST files. Every block is stored with a trailing codec
+byte, so a file may mix compressed blocks with raw ones: a block is kept raw whenever its
+compressed form would not save at least an eighth of its size.
+CodecFlate uses compress/flate, CodecLZ is a small built-in LZ77 codec that trades ratio
+for speed.
+*/
+
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecFlate
+	CodecLZ
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	case CodecLZ:
+		return "lz"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "none", "":
+		return CodecNone, nil
+	case "flate":
+		return CodecFlate, nil
+	case "lz":
+		return CodecLZ, nil
+	}
+	return CodecNone, fmt.Errorf("Invalid compression codec %q", s)
+}
+
+// ParseCodecs parses a comma separated list of codecs, one per level.
+func ParseCodecs(s string) ([]Codec, error) {
+	var codecs []Codec
+	for _, part := range strings.Split(s, ",") {
+		c, err := ParseCodec(part)
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
+
+// encodeBlock compresses block with codec and appends the codec byte of the stored form.
+func encodeBlock(codec Codec, block []byte) []byte {
+	var compressed []byte
+	switch codec {
+	case CodecFlate:
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		w.Write(block)
+		w.Close()
+		compressed = buf.Bytes()
+	case CodecLZ:
+		compressed = lzCompress(block)
+	}
+	if compressed == nil || len(compressed) >= len(block)-len(block)/8 {
+		return append(append(make([]byte, 0, len(block)+1), block...), byte(CodecNone))
+	}
+	return append(compressed, byte(codec))
+}
+
+// decodeBlock returns the raw content of a block stored with its codec byte.
+func decodeBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errors.New("Missing block trailer")
+	}
+	data := stored[:len(stored)-1]
+	switch Codec(stored[len(stored)-1]) {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return io.ReadAll(r)
+	case CodecLZ:
+		return lzDecompress(data)
+	}
+	return nil, fmt.Errorf("Unknown block codec %d", stored[len(stored)-1])
+}
+
+/*
+The LZ codec stores the raw length as a uvarint followed by a sequence of operations:
+0 | uvarint n | n literal bytes, or
+1 | uvarint offset | uvarint n, copying n bytes starting offset bytes back in the output.
+Matches are found through a hash table of the positions of 4 byte sequences.
+*/
+
+const (
+	lzMinMatch  = 4
+	lzHashBits  = 14
+	lzMaxOffset = 1 << 16
+)
+
+func lzHash(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> (32 - lzHashBits)
+}
+
+func lzCompress(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	var table [1 << lzHashBits]int32
+	literal := 0
+	flushLiteral := func(end int) {
+		if end > literal {
+			dst = append(dst, 0)
+			dst = binary.AppendUvarint(dst, uint64(end-literal))
+			dst = append(dst, src[literal:end]...)
+		}
+	}
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		h := lzHash(src[i:])
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > lzMaxOffset || !bytes.Equal(src[candidate:candidate+lzMinMatch], src[i:i+lzMinMatch]) {
+			i++
+			continue
+		}
+		n := lzMinMatch
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		flushLiteral(i)
+		dst = append(dst, 1)
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+		dst = binary.AppendUvarint(dst, uint64(n))
+		i += n
+		literal = i
+	}
+	flushLiteral(len(src))
+	return dst
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("Invalid lz block")
+	}
+	src = src[n:]
+	// the length is not trusted until the block has been decoded
+	dst := make([]byte, 0, min(size, 1<<20))
+	for len(src) > 0 {
+		op := src[0]
+		a, n := binary.Uvarint(src[1:])
+		if n <= 0 {
+			return nil, errors.New("Invalid lz block")
+		}
+		src = src[1+n:]
+		switch op {
+		case 0:
+			// dst never grows past size, so size-len(dst) cannot wrap around
+			if a > uint64(len(src)) || a > size-uint64(len(dst)) {
+				return nil, errors.New("Invalid lz literal")
+			}
+			dst = append(dst, src[:a]...)
+			src = src[a:]
+		case 1:
+			length, m := binary.Uvarint(src)
+			if m <= 0 || a == 0 || a > uint64(len(dst)) || uint64(len(dst)) > size || length > size-uint64(len(dst)) {
+				return nil, errors.New("Invalid lz copy")
+			}
+			src = src[m:]
+			start := len(dst) - int(a)
+			// byte by byte, a copy may overlap its own output
+			for k := 0; k < int(length); k++ {
+				dst = append(dst, dst[start+k])
+			}
+		default:
+			return nil, errors.New("Invalid lz operation")
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, errors.New("Invalid lz block length")
+	}
+	return dst, nil
+}
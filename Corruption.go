@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+A CorruptionPolicy decides what Open does with an SST file that fails its startup check:
+CorruptionFail refuses to open the database, CorruptionQuarantine moves the file into the
+lost/ directory of its column family and opens without it, and CorruptionReadOnly keeps
+serving it but rejects every write so nothing is built on top of damaged data.
+Every decision is reported as a CorruptionEvent, printed as a JSON line, passed to
+Options.OnCorruption and kept for Health. Corrupted blocks found by reads are reported the
+same way.
+Events are found with the database lock held, so they are queued and OnCorruption is only
+called once the lock is released (see unlock): the callback may use the database, but it
+runs on the goroutine of the read that found the corruption and must not block.
+*/
+
+type CorruptionPolicy int
+
+const (
+	CorruptionFail CorruptionPolicy = iota
+	CorruptionQuarantine
+	CorruptionReadOnly
+)
+
+func (p CorruptionPolicy) String() string {
+	switch p {
+	case CorruptionFail:
+		return "fail"
+	case CorruptionQuarantine:
+		return "quarantine"
+	case CorruptionReadOnly:
+		return "read-only"
+	}
+	return "unknown"
+}
+
+func ParseCorruptionPolicy(s string) (CorruptionPolicy, error) {
+	switch strings.ToLower(s) {
+	case "fail":
+		return CorruptionFail, nil
+	case "quarantine":
+		return CorruptionQuarantine, nil
+	case "read-only", "readonly":
+		return CorruptionReadOnly, nil
+	}
+	return CorruptionFail, fmt.Errorf("Invalid corruption policy %q", s)
+}
+
+const lostDirectory = "lost"
+
+type CorruptionEvent struct {
+	Time     time.Time `json:"time"`
+	Family   string    `json:"family"`
+	File     string    `json:"file"`
+	Smallest string    `json:"smallest"`
+	Largest  string    `json:"largest"`
+	Action   string    `json:"action"` // fail, quarantine, read-only or reported
+	Error    string    `json:"error"`
+}
+
+type HealthStatus struct {
+	Status      string            `json:"status"` // ok, degraded or read-only
+	ReadOnly    bool              `json:"readOnly"`
+	Corruptions []CorruptionEvent `json:"corruptions,omitempty"`
+}
+
+// badFile is a registered file that failed its startup check.
+type badFile struct {
+	meta *fileMeta
+	err  error
+}
+
+func (fl *FileDB) reportCorruption(cf *ColumnFamily, meta *fileMeta, action string, err error) {
+	for _, e := range fl.corruptions {
+		if e.Family == cf.Name && e.File == meta.Name && e.Action == action {
+			// reads keep hitting a damaged block, it is reported once
+			return
+		}
+	}
+	event := CorruptionEvent{
+		Time:     time.Now(),
+		Family:   cf.Name,
+		File:     meta.Name,
+		Smallest: string(meta.Smallest),
+		Largest:  string(meta.Largest),
+		Action:   action,
+		Error:    err.Error(),
+	}
+	fl.corruptions = append(fl.corruptions, event)
+	if line, err := json.Marshal(event); err == nil {
+		fmt.Println(string(line))
+	}
+	fl.pendingEvents = append(fl.pendingEvents, event)
+}
+
+// unlock releases fl.mu, then passes the events reported while it was held to
+// Options.OnCorruption. Every path that may report corruption unlocks with it.
+func (fl *FileDB) unlock() {
+	events := fl.pendingEvents
+	fl.pendingEvents = nil
+	fl.mu.Unlock()
+	if fl.options.OnCorruption == nil {
+		return
+	}
+	for _, event := range events {
+		fl.options.OnCorruption(event)
+	}
+}
+
+// handleCorruption applies the corruption policy to the files of cf that failed their check.
+func (fl *FileDB) handleCorruption(cf *ColumnFamily, bad []badFile) error {
+	policy := fl.options.CorruptionPolicy
+	for _, b := range bad {
+		fl.reportCorruption(cf, b.meta, policy.String(), b.err)
+	}
+	switch policy {
+	case CorruptionFail:
+		return fmt.Errorf("%w: %s in column family %s: %v", ErrCorruption, bad[0].meta.Name, cf.Name, bad[0].err)
+	case CorruptionQuarantine:
+		for _, b := range bad {
+			if err := cf.FileManager.quarantine(b.meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fl.readOnly = true
+	return nil
+}
+
+// quarantine unregisters a file and, unless the database is read-only, moves it to lost/.
+func (f *FileManager) quarantine(meta *fileMeta) error {
+	for i, m := range f.files {
+		if m == meta {
+			f.files = append(f.files[:i:i], f.files[i+1:]...)
+			break
+		}
+	}
+	f.tables.evict(f.path(meta))
+	if f.readOnly {
+		return nil
+	}
+	lost := filepath.Join(f.directory, lostDirectory)
+	if err := f.fs.MkdirAll(lost, 0755); err != nil {
+		return err
+	}
+	return f.fs.Rename(f.path(meta), filepath.Join(lost, meta.Name))
+}
+
+// Health reports whether corruption was found and what was done about it.
+func (fl *FileDB) Health() HealthStatus {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	status := HealthStatus{Status: "ok", ReadOnly: fl.readOnly}
+	status.Corruptions = append(status.Corruptions, fl.corruptions...)
+	if fl.readOnly && len(fl.corruptions) > 0 {
+		status.Status = "read-only"
+	} else if len(fl.corruptions) > 0 {
+		status.Status = "degraded"
+	}
+	return status
+}
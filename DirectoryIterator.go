@@ -2,62 +2,31 @@ package main
 
 
 import (
-	"os"
-	"path/filepath"
-	"sort"
 	"io"
 )
 
 /*
-An iterator pattern implementation for iterating over the files in a directory.
+An iterator pattern implementation for iterating over the SST files of a FileManager,
+newest first. When key is set, files whose key range cannot contain it are skipped.
+Files are opened through the table cache by the caller.
 */
 
 type DirectoryIterator struct {
-	file *os.File
+	files []*fileMeta
+	pos int
+	key []byte
+	meta *fileMeta
 }
 
 func (d *DirectoryIterator) Next() error {
-	currentFileInfo, err := d.file.Stat()
-	if err != nil {
-		return err
-	}
-	currentModTime := currentFileInfo.ModTime()
-	directory, err := os.ReadDir(filepath.Dir(d.file.Name()))
-	if err != nil {
-		return err
-	}
-
-	var relevantFiles []os.FileInfo
-	for _, dirEntry := range directory {
-		fileInfo, err := dirEntry.Info()
-		if err != nil {
-			return err
-		}
-
-		if !dirEntry.IsDir() && filepath.Ext(dirEntry.Name()) == ".sst" {
-			relevantFiles = append(relevantFiles, fileInfo)
+	for d.pos > 0 {
+		d.pos--
+		meta := d.files[d.pos]
+		if d.key != nil && !meta.contains(d.key) {
+			continue
 		}
+		d.meta = meta
+		return nil
 	}
-
-	sort.Slice(relevantFiles, func(i, j int) bool {
-		return relevantFiles[i].ModTime().Before(relevantFiles[j].ModTime())
-	})
-
-	var prevFile os.FileInfo
-	for _, file := range relevantFiles {
-		if file.ModTime().Before(currentModTime) {
-			prevFile = file
-		}
-	}
-
-	if prevFile != nil {
-		d.file, err = os.Open(filepath.Join(filepath.Dir(d.file.Name()), prevFile.Name()))
-		if err != nil {
-			return err
-		}
-	}else{
-		return io.EOF
-	}
-	return nil
+	return io.EOF
 }
-
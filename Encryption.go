@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+With Options.KeyProvider set, data is encrypted at rest with AES-256-GCM: every data, index
+and filter block of the SST files, every WAL record and the MANIFEST. Each sealed piece is
+nonce (12 random bytes) | ciphertext | tag (16 bytes), SST blocks being authenticated with
+their offset so they cannot be moved around. Block and record CRCs cover the sealed bytes,
+so checksums, repair framing and ValidateFile work without the keys.
+Files record the key they are written with: its ID and an 8 byte check derived from it, in
+the SST header and after the magic of the WAL and of the manifest. A missing or wrong key is
+reported as ErrMissingKey or ErrWrongKey rather than as corruption. New files use the active
+key of the provider, so once a new key is made active, compactions rewrite the SST files
+with it and the WAL and manifest switch on their next rewrite; older keys must stay
+available until no file uses them anymore.
+Blob files are not encrypted, so blob files and SetStream cannot be used with encryption.
+*/
+
+var ErrMissingKey = errors.New("Encryption key not available")
+
+var ErrWrongKey = errors.New("Encryption key does not match")
+
+const (
+	encryptionKeySize = 32
+	keyHeaderSize     = 12 // key ID (4 bytes) and key check (8 bytes)
+	sealOverhead      = 12 + 16
+)
+
+// KeyProvider supplies the keys of an encrypted database. IDs are chosen by the provider and
+// must never be reused for another key; 0 means not encrypted.
+type KeyProvider interface {
+	// ActiveKey returns the key new files are encrypted with.
+	ActiveKey() (uint32, []byte, error)
+	// Key returns the key with the given ID, to read files written with it.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeyProvider serves a fixed set of keys.
+type StaticKeyProvider struct {
+	Active uint32
+	Keys   map[uint32][]byte
+}
+
+func (p *StaticKeyProvider) ActiveKey() (uint32, []byte, error) {
+	key, err := p.Key(p.Active)
+	return p.Active, key, err
+}
+
+func (p *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: no key %d", ErrMissingKey, id)
+	}
+	return key, nil
+}
+
+// ParseKeys parses id:hexkey entries separated by commas or white space, lines starting with #
+// are comments. The last entry is the active key, so a key is rotated by appending a new one.
+func ParseKeys(s string) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{Keys: make(map[uint32][]byte)}
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, entry := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\r' }) {
+			idText, keyText, ok := strings.Cut(entry, ":")
+			id, err := strconv.ParseUint(idText, 10, 32)
+			if !ok || err != nil || id == 0 {
+				return nil, fmt.Errorf("Invalid key entry %q, expected id:hexkey with an id above 0", idText)
+			}
+			key, err := hex.DecodeString(keyText)
+			if err != nil || len(key) != encryptionKeySize {
+				return nil, fmt.Errorf("Key %d must be %d bytes written in hex", id, encryptionKeySize)
+			}
+			if _, ok := p.Keys[uint32(id)]; ok {
+				return nil, fmt.Errorf("Key %d is given twice", id)
+			}
+			p.Keys[uint32(id)] = key
+			p.Active = uint32(id)
+		}
+	}
+	if p.Active == 0 {
+		return nil, errors.New("No encryption key given")
+	}
+	return p, nil
+}
+
+// NewFileKeyProvider reads the keys of the file at path, in the format of ParseKeys.
+func NewFileKeyProvider(path string) (*StaticKeyProvider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading key file: %v", err)
+	}
+	return ParseKeys(string(content))
+}
+
+// NewEnvKeyProvider reads the keys held by the environment variable name, in the format of ParseKeys.
+func NewEnvKeyProvider(name string) (*StaticKeyProvider, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not set", name)
+	}
+	return ParseKeys(value)
+}
+
+type callbackKeyProvider struct {
+	active uint32
+	fetch  func(id uint32) ([]byte, error)
+	keys   map[uint32][]byte
+	mu     sync.Mutex
+}
+
+// NewCallbackKeyProvider serves the keys returned by fetch, for instance from a KMS, with
+// active as the active key. Fetched keys are kept in memory, fetch runs once per key.
+func NewCallbackKeyProvider(active uint32, fetch func(id uint32) ([]byte, error)) KeyProvider {
+	return &callbackKeyProvider{active: active, fetch: fetch, keys: make(map[uint32][]byte)}
+}
+
+func (p *callbackKeyProvider) ActiveKey() (uint32, []byte, error) {
+	key, err := p.Key(p.active)
+	return p.active, key, err
+}
+
+func (p *callbackKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	key, err := p.fetch(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: %v", ErrMissingKey, id, err)
+	}
+	p.keys[id] = key
+	return key, nil
+}
+
+// encryptor seals and opens data with one key.
+type encryptor struct {
+	id    uint32
+	check []byte
+	aead  cipher.AEAD
+}
+
+func newEncryptor(id uint32, key []byte) (*encryptor, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("Key %d must be %d bytes for AES-256, got %d", id, encryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptor{id: id, check: keyCheck(key), aead: aead}, nil
+}
+
+// keyCheck tells keys apart without revealing anything about them.
+func keyCheck(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("lentadb key check"), key...))
+	return sum[:8]
+}
+
+// activeEncryptor returns the encryptor of the active key, nil when keys is nil.
+func activeEncryptor(keys KeyProvider) (*encryptor, error) {
+	if keys == nil {
+		return nil, nil
+	}
+	id, key, err := keys.ActiveKey()
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, errors.New("The active key cannot have ID 0")
+	}
+	return newEncryptor(id, key)
+}
+
+// keyEncryptor returns the encryptor of the key a file recorded, id 0 meaning not encrypted.
+func keyEncryptor(keys KeyProvider, id uint32, check []byte) (*encryptor, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%w: key %d is needed but no key provider is configured", ErrMissingKey, id)
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEncryptor(id, key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(e.check, check) {
+		return nil, fmt.Errorf("%w: key %d", ErrWrongKey, id)
+	}
+	return e, nil
+}
+
+// header returns the key ID and check recorded by the files e writes.
+func (e *encryptor) header() []byte {
+	return append(binary.BigEndian.AppendUint32(nil, e.id), e.check...)
+}
+
+// readKeyHeader returns the encryptor of the key recorded by header.
+func readKeyHeader(header []byte, keys KeyProvider) (*encryptor, error) {
+	if len(header) < keyHeaderSize {
+		return nil, errors.New("Truncated key header")
+	}
+	id := binary.BigEndian.Uint32(header)
+	if id == 0 {
+		return nil, errors.New("Invalid key ID 0 in key header")
+	}
+	return keyEncryptor(keys, id, header[4:keyHeaderSize])
+}
+
+// seal encrypts plaintext, authenticating data along with it.
+func (e *encryptor) seal(plaintext, data []byte) []byte {
+	out := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plaintext)+e.aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		// the system random source failing is not something to write data through
+		panic(err)
+	}
+	return e.aead.Seal(out, out, plaintext, data)
+}
+
+// open decrypts what seal returned, an authentication failure is corruption.
+func (e *encryptor) open(sealed, data []byte) ([]byte, error) {
+	n := e.aead.NonceSize()
+	if len(sealed) < n+e.aead.Overhead() {
+		return nil, fmt.Errorf("%w: encrypted data too small", ErrCorruption)
+	}
+	plaintext, err := e.aead.Open(nil, sealed[:n], sealed[n:], data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decryption failed", ErrCorruption)
+	}
+	return plaintext, nil
+}
+
+// sealContent seals a whole file with the active key of keys, after magic and the key
+// header. Without keys the content is returned as is.
+func sealContent(content, magic []byte, keys KeyProvider) ([]byte, error) {
+	enc, err := activeEncryptor(keys)
+	if err != nil || enc == nil {
+		return content, err
+	}
+	sealed := append(append([]byte{}, magic...), enc.header()...)
+	return append(sealed, enc.seal(content, magic)...), nil
+}
+
+// openContent opens what sealContent returned, content without magic being plain text.
+func openContent(content, magic []byte, keys KeyProvider) ([]byte, error) {
+	if !bytes.HasPrefix(content, magic) {
+		return content, nil
+	}
+	content = content[len(magic):]
+	enc, err := readKeyHeader(content, keys)
+	if err != nil {
+		return nil, err
+	}
+	return enc.open(content[keyHeaderSize:], magic)
+}
+
+// offsetData authenticates a block with its offset in the file.
+func offsetData(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"encoding/binary"
+	"strings"
 )
 
 type Entry struct {
@@ -20,4 +21,15 @@ func (e *Entry) toBytes() []byte {
     entry[len(e.Key)+3] = 61
     copy(entry[len(e.Key)+4:], e.Value)
     return entry
-}
\ No newline at end of file
+}
+
+// decodeEntry parses a record body (type | key=value) as stored in SST files.
+// Only the first '=' separates the key from the value, so values may contain '='.
+func decodeEntry(data []byte) Entry {
+    s := string(data[1:])
+    key, value := s, ""
+    if i := strings.IndexByte(s, '='); i >= 0 {
+        key, value = s[:i], s[i+1:]
+    }
+    return Entry{Key: key, Value: value, t: int(data[0])}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Export writes the live keys of a column family, in key order, as NDJSON (one
+{"key": ..., "value": ...} object per line) or as CSV (a key,value,encoding header then one
+row per key). Keys and values that are not valid UTF-8 are written in base64 and the record
+carries "encoding": "base64", which then applies to both. Export reads through an Iterator,
+so it holds one block and one value at a time and writers are not blocked while it runs.
+Import reads either format back and writes the records in batches of batchSize, so a file
+is loaded much faster than with one write per key and a failed import can simply be run again.
+*/
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+var csvHeader = []string{"key", "value", "encoding"}
+
+type exportRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"` // base64 when the key or the value is not valid UTF-8
+}
+
+func newExportRecord(key, value []byte) exportRecord {
+	if utf8.Valid(key) && utf8.Valid(value) {
+		return exportRecord{Key: string(key), Value: string(value)}
+	}
+	return exportRecord{
+		Key:      base64.StdEncoding.EncodeToString(key),
+		Value:    base64.StdEncoding.EncodeToString(value),
+		Encoding: "base64",
+	}
+}
+
+func (r exportRecord) decode() ([]byte, []byte, error) {
+	switch r.Encoding {
+	case "":
+		return []byte(r.Key), []byte(r.Value), nil
+	case "base64":
+		key, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(r.Value)
+		return key, value, err
+	}
+	return nil, nil, fmt.Errorf("Unknown encoding %q", r.Encoding)
+}
+
+// ExportOptions select the keys to export: those starting with Prefix and within [Start, End),
+// an empty bound meaning no bound.
+type ExportOptions struct {
+	Format string // FormatNDJSON or FormatCSV
+	Prefix []byte
+	Start  []byte
+	End    []byte
+}
+
+// Export writes the selected keys of cf to w and returns how many it wrote. progress, when
+// set, is called with the number of records written so far after every record.
+func Export(cf *ColumnFamily, w io.Writer, opts ExportOptions, progress func(int)) (int, error) {
+	start, end := opts.Start, opts.End
+	if len(end) == 0 {
+		end = nil
+	}
+	if len(opts.Prefix) > 0 {
+		if string(opts.Prefix) > string(start) {
+			start = opts.Prefix
+		}
+		if pe := prefixEnd(opts.Prefix); pe != nil && (end == nil || string(pe) < string(end)) {
+			end = pe
+		}
+	}
+	out := bufio.NewWriter(w)
+	var write func(exportRecord) error
+	switch opts.Format {
+	case FormatNDJSON, "":
+		encoder := json.NewEncoder(out)
+		write = func(r exportRecord) error {
+			return encoder.Encode(r)
+		}
+	case FormatCSV:
+		writer := csv.NewWriter(out)
+		if err := writer.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		write = func(r exportRecord) error {
+			if err := writer.Write([]string{r.Key, r.Value, r.Encoding}); err != nil {
+				return err
+			}
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return 0, fmt.Errorf("Invalid export format %q", opts.Format)
+	}
+	it, err := cf.NewIterator(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	count := 0
+	for {
+		key, value, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := write(newExportRecord(key, value)); err != nil {
+			return count, err
+		}
+		count++
+		if progress != nil {
+			progress(count)
+		}
+	}
+	return count, out.Flush()
+}
+
+type ImportProgress struct {
+	Records int   // records written
+	Bytes   int64 // bytes of input read
+}
+
+// countingReader counts the bytes read through it for the progress reports.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Import writes the records read from r into cf in batches of batchSize and returns how many
+// it wrote. progress, when set, is called after every batch.
+func Import(cf *ColumnFamily, r io.Reader, format string, batchSize int, progress func(ImportProgress)) (int, error) {
+	if batchSize < 1 {
+		return 0, errors.New("Batch size must be at least 1")
+	}
+	input := &countingReader{r: bufio.NewReader(r)}
+	var next func() (exportRecord, error)
+	switch format {
+	case FormatNDJSON, "":
+		decoder := json.NewDecoder(input)
+		next = func() (exportRecord, error) {
+			var record exportRecord
+			err := decoder.Decode(&record)
+			return record, err
+		}
+	case FormatCSV:
+		reader := csv.NewReader(input)
+		reader.FieldsPerRecord = -1
+		first := true
+		next = func() (exportRecord, error) {
+			row, err := reader.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			if first {
+				first = false
+				if strings.Join(row, ",") == strings.Join(csvHeader, ",") {
+					return next()
+				}
+			}
+			if len(row) < 2 || len(row) > 3 {
+				return exportRecord{}, fmt.Errorf("Expected key,value[,encoding], got %d columns", len(row))
+			}
+			record := exportRecord{Key: row[0], Value: row[1]}
+			if len(row) == 3 {
+				record.Encoding = row[2]
+			}
+			return record, nil
+		}
+	default:
+		return 0, fmt.Errorf("Invalid import format %q", format)
+	}
+
+	count := 0
+	batch := NewWriteBatch()
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		if err := cf.db.Write(batch); err != nil {
+			return fmt.Errorf("Error writing records %d to %d: %w", count-batch.Len()+1, count, err)
+		}
+		batch = NewWriteBatch()
+		if progress != nil {
+			progress(ImportProgress{Records: count, Bytes: input.n})
+		}
+		return nil
+	}
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count - batch.Len(), fmt.Errorf("Error reading record %d: %v", count+1, err)
+		}
+		key, value, err := record.decode()
+		if err != nil {
+			return count - batch.Len(), fmt.Errorf("Error decoding record %d: %v", count+1, err)
+		}
+		batch.Set(cf.Name, key, value)
+		count++
+		if batch.Len() >= batchSize {
+			if err := flush(); err != nil {
+				return count - batch.Len(), err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return count - batch.Len(), err
+	}
+	return count, nil
+}
+
+// formatOf picks the format of a file from its extension when none is given.
+func formatOf(format, path string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return FormatCSV
+	}
+	return FormatNDJSON
+}
+
+// exportCommand implements lentadb export [--format ndjson|csv] [--family name] [--prefix p]
+// [--start key] [--end key] [--output file] <dir>.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "", "ndjson or csv, from the output extension by default")
+	family := fs.String("family", DefaultColumnFamily, "column family to export")
+	prefix := fs.String("prefix", "", "only export the keys starting with prefix")
+	start := fs.String("start", "", "first key to export")
+	end := fs.String("end", "", "export the keys before end")
+	output := fs.String("output", "", "file to write, standard output by default")
+	if err := parseInterspersed(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: lentadb export [--format ndjson|csv] [--family name] [--prefix p] [--start key] [--end key] [--output file] <dir>")
+		return 2
+	}
+	dbOptions, err := commandOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	// a read-only open works next to a running server
+	db, err := OpenReadOnlyWithOptions(fs.Arg(0), true, dbOptions)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer db.Close()
+	cf, err := db.Family(*family)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	opts := ExportOptions{Format: formatOf(*format, *output), Prefix: []byte(*prefix), Start: []byte(*start), End: []byte(*end)}
+	last := time.Now()
+	count, err := Export(cf, w, opts, func(n int) {
+		if time.Since(last) >= time.Second {
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "exported %d records\n", n)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Export failed:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records\n", count)
+	return 0
+}
+
+// importCommand implements lentadb import [--format ndjson|csv] [--family name] [--batch-size n] <dir> <file>.
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "ndjson or csv, from the file extension by default")
+	family := fs.String("family", DefaultColumnFamily, "column family to import into, created when missing")
+	batchSize := fs.Int("batch-size", 1000, "records per write batch")
+	if err := parseInterspersed(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Println("usage: lentadb import [--format ndjson|csv] [--family name] [--batch-size n] <dir> <file>")
+		return 2
+	}
+	input, err := os.Open(fs.Arg(1))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer input.Close()
+	var size int64
+	if info, err := input.Stat(); err == nil {
+		size = info.Size()
+	}
+	opts, err := commandOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	db, err := Open(fs.Arg(0), opts)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer db.Close()
+	cf, err := db.Family(*family)
+	if errors.Is(err, ErrColumnFamilyNotFound) {
+		cf, err = db.CreateFamily(*family, nil)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	last := time.Now()
+	count, err := Import(cf, input, formatOf(*format, fs.Arg(1)), *batchSize, func(p ImportProgress) {
+		if time.Since(last) >= time.Second {
+			last = time.Now()
+			fmt.Printf("imported %d records, %d of %d bytes read\n", p.Records, p.Bytes, size)
+		}
+	})
+	if err != nil {
+		fmt.Printf("Import failed after %d records: %v\n", count, err)
+		return 1
+	}
+	fmt.Printf("imported %d records\n", count)
+	return 0
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FaultFS is a MemFS that models what survives a power loss, for crash tests. The content of
+a file is durable once the file is synced, and the creation, rename or removal of a file
+once its directory is synced; Crash throws away everything else, optionally keeping a random
+part of it the way a disk may write some of its cache before losing power: a prefix of the
+unsynced writes of each file, the last one possibly torn, and a prefix of the unsynced entry
+changes of each directory. Directories themselves are created, renamed and removed durably
+right away.
+Faults are injected with FailNth, which makes one write, sync or rename fail, and CrashAfter,
+which stops the filesystem after a number of operations as if the machine had died there:
+every later call fails with ErrCrashed until Crash simulates the reboot.
+*/
+
+var ErrInjectedFault = errors.New("Injected fault")
+
+var ErrCrashed = errors.New("Filesystem crashed")
+
+// FaultOp is a kind of operation FailNth can make fail.
+type FaultOp int
+
+const (
+	FaultWrite  FaultOp = iota // writes and truncations of files
+	FaultSync                  // syncs of files and directories
+	FaultRename                // renames of files and directories
+	faultOps
+)
+
+// faultNone marks the other operations that change the filesystem, CrashAfter counts them too.
+const faultNone FaultOp = -1
+
+type FaultFS struct {
+	mu      sync.Mutex
+	mem     *MemFS
+	synced  map[*memNode][]byte       // content of every file as of its last sync
+	pending map[*memNode][]fileChange // writes of every file since its last sync
+	durable map[string]*memNode       // file entries as of the last sync of their directory
+	changes map[string][]entryChange  // entry changes of every directory since its last sync
+	counts  [faultOps]int
+	fail    [faultOps]int // count at which the operation fails, 0 for none
+	left    int           // operations before the crash, 0 for none
+	halted  bool
+	gen     int // incremented by every crash, files and locks of earlier generations are dead
+}
+
+// fileChange is a write of data at offset, or a truncation to size when data is nil.
+type fileChange struct {
+	offset int64
+	data   []byte
+	size   int64
+}
+
+// entryChange sets the entry path of a directory to node, or removes it when node is nil. A
+// rename also removes the entry from.
+type entryChange struct {
+	path string
+	node *memNode
+	from string
+}
+
+func NewFaultFS() *FaultFS {
+	return &FaultFS{
+		mem:     NewMemFS(),
+		synced:  make(map[*memNode][]byte),
+		pending: make(map[*memNode][]fileChange),
+		durable: make(map[string]*memNode),
+		changes: make(map[string][]entryChange),
+	}
+}
+
+// FailNth makes the nth next operation of kind op fail with ErrInjectedFault, without any
+// effect. Only one failure per kind is pending at a time.
+func (f *FaultFS) FailNth(op FaultOp, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[op] = f.counts[op] + n
+}
+
+// CrashAfter lets n more operations change the filesystem, then stops it: the next one and
+// every call after it fail with ErrCrashed.
+func (f *FaultFS) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.left = n + 1
+}
+
+// Crashed reports whether the filesystem stopped after CrashAfter.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.halted
+}
+
+// Crash simulates a power loss and the reboot that follows: only the synced content and
+// entries are left, plus a random part of the others when rng is set. Open files and locks
+// are lost and pending faults are cleared.
+func (f *FaultFS) Crash(rng *rand.Rand) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.mem
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, dir := range f.changedDirs() {
+		changes := f.changes[dir]
+		f.applyEntries(changes[:randomPrefix(rng, len(changes))])
+	}
+	files := make(map[string]*memNode)
+	rebuilt := make(map[*memNode]*memNode)
+	for _, path := range f.durablePaths() {
+		node := f.durable[path]
+		if _, ok := rebuilt[node]; !ok {
+			rebuilt[node] = &memNode{data: f.survivingContent(node, rng), modTime: node.modTime}
+		}
+		files[path] = rebuilt[node]
+	}
+	m.files = files
+	m.locks = make(map[string]bool)
+	f.synced = make(map[*memNode][]byte)
+	f.pending = make(map[*memNode][]fileChange)
+	f.durable = make(map[string]*memNode)
+	f.changes = make(map[string][]entryChange)
+	for path, node := range files {
+		f.synced[node] = append([]byte{}, node.data...)
+		f.durable[path] = node
+	}
+	f.fail = [faultOps]int{}
+	f.left = 0
+	f.halted = false
+	f.gen++
+}
+
+// changedDirs returns the directories with unsynced entry changes, sorted so a seeded crash
+// is reproducible.
+func (f *FaultFS) changedDirs() []string {
+	dirs := make([]string, 0, len(f.changes))
+	for dir := range f.changes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// durablePaths returns the paths of the durable file entries, sorted.
+func (f *FaultFS) durablePaths() []string {
+	paths := make([]string, 0, len(f.durable))
+	for path := range f.durable {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// randomPrefix returns how many of n unsynced changes survive a crash.
+func randomPrefix(rng *rand.Rand, n int) int {
+	if rng == nil {
+		return 0
+	}
+	return rng.Intn(n + 1)
+}
+
+// survivingContent returns the synced content of node, followed by what survives of its unsynced writes.
+func (f *FaultFS) survivingContent(node *memNode, rng *rand.Rand) []byte {
+	data := append([]byte{}, f.synced[node]...)
+	changes := f.pending[node]
+	kept := randomPrefix(rng, len(changes))
+	for i, c := range changes {
+		if i > kept || i == kept && (rng == nil || c.data == nil) {
+			break
+		}
+		if c.data == nil {
+			data = resize(data, c.size)
+			continue
+		}
+		written := c.data
+		if i == kept {
+			// the write the power loss interrupted
+			written = written[:rng.Intn(len(written)+1)]
+		}
+		if end := c.offset + int64(len(written)); end > int64(len(data)) {
+			data = resize(data, end)
+		}
+		copy(data[c.offset:], written)
+	}
+	return data
+}
+
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+// applyEntries makes entry changes durable, the caller holds the locks.
+func (f *FaultFS) applyEntries(changes []entryChange) {
+	for _, c := range changes {
+		if c.from != "" && f.durable[c.from] == c.node {
+			delete(f.durable, c.from)
+		}
+		if c.node == nil {
+			delete(f.durable, c.path)
+		} else {
+			f.durable[c.path] = c.node
+		}
+	}
+}
+
+// record notes an entry change in the directory of c.path, the caller holds f.mu.
+func (f *FaultFS) record(c entryChange) {
+	dir := filepath.Dir(c.path)
+	f.changes[dir] = append(f.changes[dir], c)
+}
+
+// check counts an operation and tells whether it may run, the caller holds f.mu.
+func (f *FaultFS) check(op FaultOp) error {
+	if f.halted {
+		return ErrCrashed
+	}
+	if f.left > 0 {
+		f.left--
+		if f.left == 0 {
+			f.halted = true
+			return ErrCrashed
+		}
+	}
+	if op == faultNone {
+		return nil
+	}
+	f.counts[op]++
+	if f.fail[op] == f.counts[op] {
+		f.fail[op] = 0
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// alive fails once the filesystem stopped, for the calls that change nothing.
+func (f *FaultFS) alive() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.halted {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// node returns the file at path, nil for none.
+func (f *FaultFS) node(path string) *memNode {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	return f.mem.files[filepath.Clean(path)]
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op := faultNone
+	if flag&os.O_TRUNC != 0 {
+		op = FaultWrite
+	}
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := f.check(op); err != nil {
+			return nil, err
+		}
+	} else if f.halted {
+		return nil, ErrCrashed
+	}
+	existing := f.node(name)
+	file, err := f.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	mf := file.(*memFile)
+	if existing == nil {
+		f.synced[mf.node] = nil
+		f.record(entryChange{path: filepath.Clean(name), node: mf.node})
+	} else if flag&os.O_TRUNC != 0 && mf.writable {
+		f.pending[mf.node] = append(f.pending[mf.node], fileChange{size: 0})
+	}
+	return &faultFile{fs: f, file: mf, gen: f.gen}, nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(FaultRename); err != nil {
+		return err
+	}
+	from, to := filepath.Clean(oldpath), filepath.Clean(newpath)
+	node := f.node(from)
+	if node == nil {
+		return f.renameDir(oldpath, newpath)
+	}
+	if err := f.mem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	f.record(entryChange{path: to, node: node, from: from})
+	return nil
+}
+
+// renameDir renames a directory durably, with the entries below it.
+func (f *FaultFS) renameDir(oldpath, newpath string) error {
+	if err := f.mem.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	from, to := filepath.Clean(oldpath), filepath.Clean(newpath)
+	moved := func(p string) (string, bool) {
+		if strings.HasPrefix(p, from+string(filepath.Separator)) {
+			return to + strings.TrimPrefix(p, from), true
+		}
+		return p, false
+	}
+	for _, dir := range f.changedDirs() {
+		changes := f.changes[dir]
+		if _, ok := moved(dir); ok || dir == from {
+			// the entries below are written along with the directory
+			f.mem.mu.Lock()
+			f.applyEntries(changes)
+			f.mem.mu.Unlock()
+			delete(f.changes, dir)
+		}
+	}
+	for _, p := range f.durablePaths() {
+		if target, ok := moved(p); ok {
+			f.durable[target] = f.durable[p]
+			delete(f.durable, p)
+		}
+	}
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(faultNone); err != nil {
+		return err
+	}
+	node := f.node(name)
+	if err := f.mem.Remove(name); err != nil {
+		return err
+	}
+	if node != nil {
+		f.record(entryChange{path: filepath.Clean(name)})
+	}
+	return nil
+}
+
+func (f *FaultFS) RemoveAll(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(faultNone); err != nil {
+		return err
+	}
+	clean := filepath.Clean(path)
+	if f.node(clean) != nil {
+		f.record(entryChange{path: clean})
+		return f.mem.RemoveAll(path)
+	}
+	if err := f.mem.RemoveAll(path); err != nil {
+		return err
+	}
+	prefix := clean + string(filepath.Separator)
+	for p := range f.durable {
+		if strings.HasPrefix(p, prefix) {
+			delete(f.durable, p)
+		}
+	}
+	for dir := range f.changes {
+		if dir == clean || strings.HasPrefix(dir, prefix) {
+			delete(f.changes, dir)
+		}
+	}
+	return nil
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := f.alive(); err != nil {
+		return nil, err
+	}
+	return f.mem.ReadDir(name)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.alive(); err != nil {
+		return nil, err
+	}
+	return f.mem.Stat(name)
+}
+
+func (f *FaultFS) Mkdir(name string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(faultNone); err != nil {
+		return err
+	}
+	return f.mem.Mkdir(name, perm)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(faultNone); err != nil {
+		return err
+	}
+	return f.mem.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(faultNone); err != nil {
+		return err
+	}
+	node := f.node(oldname)
+	if err := f.mem.Link(oldname, newname); err != nil {
+		return err
+	}
+	f.record(entryChange{path: filepath.Clean(newname), node: node})
+	return nil
+}
+
+func (f *FaultFS) Chtimes(name string, atime, mtime time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(faultNone); err != nil {
+		return err
+	}
+	return f.mem.Chtimes(name, atime, mtime)
+}
+
+func (f *FaultFS) SyncDir(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check(FaultSync); err != nil {
+		return err
+	}
+	if err := f.mem.SyncDir(name); err != nil {
+		return err
+	}
+	dir := filepath.Clean(name)
+	f.mem.mu.Lock()
+	f.applyEntries(f.changes[dir])
+	f.mem.mu.Unlock()
+	delete(f.changes, dir)
+	return nil
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.halted {
+		return nil, false, ErrCrashed
+	}
+	lock, locked, err := f.mem.Lock(name)
+	if !locked {
+		return nil, locked, err
+	}
+	return &faultLock{fs: f, lock: lock, gen: f.gen}, true, nil
+}
+
+// faultLock is a lock of a FaultFS, a crash releases it.
+type faultLock struct {
+	fs   *FaultFS
+	lock io.Closer
+	gen  int
+}
+
+func (l *faultLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.gen != l.fs.gen {
+		return nil
+	}
+	return l.lock.Close()
+}
+
+// faultFile is an open file of a FaultFS, it records its writes until they are synced.
+type faultFile struct {
+	fs   *FaultFS
+	file *memFile
+	gen  int
+}
+
+// alive fails for a file opened before the last crash, the caller holds fs.mu.
+func (f *faultFile) alive() error {
+	if f.fs.halted || f.gen != f.fs.gen {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	err := f.alive()
+	f.fs.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	err := f.alive()
+	f.fs.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.alive(); err != nil {
+		return 0, err
+	}
+	if err := f.fs.check(FaultWrite); err != nil {
+		return 0, err
+	}
+	offset := f.file.offset
+	if f.file.append {
+		f.file.node.mu.Lock()
+		offset = int64(len(f.file.node.data))
+		f.file.node.mu.Unlock()
+	}
+	n, err := f.file.Write(p)
+	if n > 0 {
+		f.fs.pending[f.file.node] = append(f.fs.pending[f.file.node], fileChange{offset: offset, data: append([]byte{}, p[:n]...)})
+	}
+	return n, err
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.alive(); err != nil {
+		return err
+	}
+	if err := f.fs.check(FaultWrite); err != nil {
+		return err
+	}
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.fs.pending[f.file.node] = append(f.fs.pending[f.file.node], fileChange{size: size})
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.alive(); err != nil {
+		return err
+	}
+	if err := f.fs.check(FaultSync); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	node := f.file.node
+	node.mu.Lock()
+	f.fs.synced[node] = append([]byte{}, node.data...)
+	node.mu.Unlock()
+	delete(f.fs.pending, node)
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *faultFile) Name() string {
+	return f.file.Name()
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	err := f.alive()
+	f.fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
@@ -1,21 +1,37 @@
 package main
 
 import (
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
+    "errors"
+    "fmt"
+    "io"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
 )
 
 
 /*
 The FileDB type is the type of the database that is stored on disk. It has a FileManager, a MemTable, a MaxEntrySize and a CacheSize.
+FileManager and MemTable belong to the default column family, other families are reached through Family.
 it provides the following methods:
-exists: checks if a key exists in the database
-Set: sets a key value pair in the database
-Get: gets a value from the database
-Del: deletes a key value pair from the database
+exists: checks if a key exists in a column family
+Set: sets a key value pair in the default column family
+Get: gets a value from the default column family
+Del: deletes a key value pair from the default column family
+Write: atomically applies a WriteBatch spanning any number of column families
+CreateFamily, Family, DropFamily, Families: manage the column families
 NewFileDB: factory method to create a new FileDB
+Open: opens (or creates) the database stored in a directory with the given Options
+Sync: forces the WAL to stable storage
+TableCacheStats: reports how well the table cache of open SST files performs
+BlockCacheStats: reports the hit ratio and memory usage of the block cache
+Health: reports the corruption found in the SST files and what the corruption policy did
+Checkpoint: writes a consistent copy of the database, hard-linking its SST files
+LastSequence: returns the sequence number of the last write, the unit of point-in-time recovery
+Close: flushes the MemTables and releases the files and the directory lock of the database
+OpenReadOnly: opens a database for reads only, without locking or modifying its directory
+SetStream, GetStream: store and read large values without holding them in memory
 */
 
 type FileDB struct {
@@ -23,29 +39,40 @@ type FileDB struct {
     MemTable *MemTable
     MaxEntrySize int
     CacheSize int
+    directory string
+    options *Options
+    wal *WAL
+    families map[string]*ColumnFamily
+    lock io.Closer
+    tables *TableCache
+    blocks *BlockCache
+    corruptions []CorruptionEvent
+    pendingEvents []CorruptionEvent // reported but not passed to OnCorruption yet
+    seq uint64 // sequence number of the last write
+    flushedSeq uint64 // sequence number of the last write held by the SST files
+    readOnly bool
+    closed bool
+    mu sync.Mutex
 }
 
-func (fl *FileDB) exists(key []byte) ([]byte, error) {
-    if v, ok := fl.MemTable.Memdata[string(key)]; ok {
-        if v.t == 1 {
-            return nil, nil
-        } else {
-            return []byte(v.Value), nil
-        }
-    }
-    it := DirectoryIterator{file: fl.FileManager.WritePointer}
-    mp, err := fl.FileManager.Read()
-    if err != nil {
-        fmt.Println("Error in exists 4")
-        return nil, err
-    }
-    if v, ok := mp[string(key)]; ok {
-        if v.t == 1 {
-            return nil, nil
-        } else {
-            return []byte(v.Value), nil
-        }
+var ErrClosed = errors.New("Database is closed")
+
+// ReadOnlyError is returned by every mutation of a database opened with OpenReadOnly.
+type ReadOnlyError struct {
+    Op string
+}
+
+func (e *ReadOnlyError) Error() string {
+    return "Database is opened read-only, " + e.Op + " rejected"
+}
+
+// find returns the newest entry of key as stored, a blob entry still holding its pointer, and
+// the file it was read from, nil for the MemTable. ok is false for a missing or deleted key.
+func (fl *FileDB) find(cf *ColumnFamily, key []byte, ro *ReadOptions) (Entry, *fileMeta, bool, error) {
+    if v, ok := cf.MemTable.Memdata[string(key)]; ok {
+        return v, nil, v.t != 1, nil
     }
+    it := cf.FileManager.iterator(key)
     for {
         err := it.Next()
         if err == io.EOF {
@@ -53,97 +80,597 @@ func (fl *FileDB) exists(key []byte) ([]byte, error) {
         }
         if err != nil {
             fmt.Println("Error in exists 3")
-            return nil, err
+            return Entry{}, nil, false, err
         }
-        mp, err := fl.FileManager.loadFile(it.file)
+        reader, err := cf.FileManager.reader(it.meta)
         if err != nil {
             fmt.Println("Error in exists 2")
-            return nil, err
+            return Entry{}, nil, false, err
         }
-        if v, ok := mp[string(key)]; ok {
-            if v.t == 1 {
-                return nil, nil
-            } else {
-                return []byte(v.Value), nil
-            }
+        if cf.FileManager.expired(reader.modTime) {
+            // files are visited newest first, everything older is expired as well
+            reader.Close()
+            break
+        }
+        v, ok, err := reader.Get(key, ro)
+        reader.Close()
+        if errors.Is(err, ErrCorruption) {
+            fl.reportCorruption(cf, it.meta, "reported", err)
         }
         if err != nil {
             fmt.Println("Error in exists 1")
-            return nil, err
+            return Entry{}, nil, false, err
+        }
+        if ok {
+            return v, it.meta, v.t != 1, nil
         }
     }
-    return nil, nil
+    return Entry{}, nil, false, nil
+}
+
+func (fl *FileDB) exists(cf *ColumnFamily, key []byte, ro *ReadOptions) ([]byte, error) {
+    v, meta, ok, err := fl.find(cf, key, ro)
+    if err != nil || !ok {
+        return nil, err
+    }
+    v, err = cf.FileManager.resolve(v, ro)
+    if errors.Is(err, ErrCorruption) && meta != nil {
+        fl.reportCorruption(cf, meta, "reported", err)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return []byte(v.Value), nil
 }
 
 func (fl *FileDB) Set(key, value []byte) error {
-    if len(key) +len(value) +1 > fl.MaxEntrySize {
-        return errors.New("Entry size too large")
-    }
-    fl.MemTable.Memdata[string(key)] = Entry{Key: string(key), Value: string(value), t: 0}
-    logSize:=2+len(key)+len(value)+1+1;
-    logEntry:=make([]byte, logSize)
-    binary.BigEndian.PutUint16(logEntry, uint16(len(key)+len(value)+2))
-    logEntry[2]=0
-    copy(logEntry[3:], key)
-    logEntry[len(key)+3]=61
-    copy(logEntry[len(key)+4:], value)
-    err:=fl.FileManager.Log(logEntry)
+    return fl.families[DefaultColumnFamily].Set(key, value)
+}
+
+
+func (fl *FileDB) Get(key []byte) ([]byte, error) {
+    return fl.families[DefaultColumnFamily].Get(key)
+}
+
+// GetWithOptions is Get with per read options.
+func (fl *FileDB) GetWithOptions(key []byte, ro *ReadOptions) ([]byte, error) {
+    return fl.families[DefaultColumnFamily].GetWithOptions(key, ro)
+}
+
+
+
+func (fl *FileDB) Del(key []byte) ([]byte, error) {
+    return fl.families[DefaultColumnFamily].Del(key)
+}
+
+func (fl *FileDB) Write(b *WriteBatch) error {
+    if fl.readOnly {
+        return &ReadOnlyError{Op: "write"}
+    }
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    if fl.closed {
+        return ErrClosed
+    }
+    return fl.write(b)
+}
+
+func (fl *FileDB) write(b *WriteBatch) error {
+    for _, op := range b.ops {
+        if _, ok := fl.families[op.family]; !ok {
+            return ErrColumnFamilyNotFound
+        }
+        size := len(op.key) +len(op.value) +1
+        if fl.options.BlobThreshold > 0 && len(op.value) >= fl.options.BlobThreshold {
+            // the SST files only hold a pointer to the value
+            size = len(op.key) +blobPointerSize +1
+        }
+        if size > fl.MaxEntrySize {
+            return errors.New("Entry size too large")
+        }
+    }
+    return fl.writeAt(fl.seq+1, time.Now(), b)
+}
+
+// writeAt logs and applies b as write seq made at ts. Point-in-time recovery uses it to
+// replay archived records with their original sequence number and time.
+func (fl *FileDB) writeAt(seq uint64, ts time.Time, b *WriteBatch) error {
+    err := fl.wal.Append(seq, ts, b.encode())
     if err != nil {
         return err
     }
-    if len(fl.MemTable.Memdata)>fl.CacheSize {
-        fl.FileManager.flushMem(fl.MemTable);
-        fl.MemTable.Memdata = make(map[string]Entry)
+    fl.seq = seq
+    fl.apply(b)
+    return fl.maybeFlush()
+}
+
+// LastSequence returns the sequence number of the last write, 0 for a database never written.
+func (fl *FileDB) LastSequence() uint64 {
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    return fl.seq
+}
+
+// apply inserts the operations of a batch into the MemTables, skipping families that no longer exist.
+func (fl *FileDB) apply(b *WriteBatch) {
+    for _, op := range b.ops {
+        cf, ok := fl.families[op.family]
+        if !ok {
+            continue
+        }
+        cf.MemTable.Memdata[string(op.key)] = Entry{Key: string(op.key), Value: string(op.value), t: op.t}
     }
-    return  nil
 }
 
+func (fl *FileDB) maybeFlush() error {
+    for _, cf := range fl.families {
+        if len(cf.MemTable.Memdata) > cf.cacheSize() {
+            return fl.flush()
+        }
+    }
+    return nil
+}
 
-func (fl *FileDB) Get(key []byte) ([]byte, error) {
-    v, err := fl.exists(key)
+// flush writes every non empty MemTable to its family's SST files and registers them in the
+// manifest. The WAL is shared, so it can only be emptied once all of them are on disk.
+func (fl *FileDB) flush() error {
+    for _, cf := range fl.families {
+        if len(cf.MemTable.Memdata) == 0 {
+            continue
+        }
+        err := cf.FileManager.flushMem(cf.MemTable)
+        if err != nil {
+            return err
+        }
+        cf.MemTable.Memdata = make(map[string]Entry)
+    }
+    fl.flushedSeq = fl.seq
+    err := fl.saveManifest()
+    if err != nil {
+        return err
+    }
+    err = fl.wal.Reset()
+    if err != nil {
+        return err
+    }
+    fl.compact()
+    fl.sweepBlobs()
+    return nil
+}
+
+// compact runs the compaction of every family that reached its trigger. The replaced files
+// are only removed once the manifest no longer lists them.
+func (fl *FileDB) compact() {
+    for _, cf := range fl.families {
+        obsolete, obsoleteBlobs, err := cf.FileManager.compact(cf.MemTable)
+        if err != nil {
+            fmt.Println("Error compacting SST files")
+            fmt.Println(err)
+            continue
+        }
+        if len(obsolete) == 0 {
+            continue
+        }
+        err = fl.saveManifest()
+        if err != nil {
+            fmt.Println("Error saving manifest")
+            fmt.Println(err)
+            return
+        }
+        cf.FileManager.removeFiles(obsolete)
+        cf.FileManager.removeBlobs(obsoleteBlobs)
+    }
+}
+
+// sweepBlobs removes the blob files of the families that do not compact once no live entry
+// refers to them, after the manifest no longer lists them. They stay registered when the
+// manifest cannot be saved, so a later sweep removes them.
+func (fl *FileDB) sweepBlobs() {
+    for _, cf := range fl.families {
+        dead, err := cf.FileManager.sweepBlobs(cf.MemTable)
+        if err != nil {
+            fmt.Println("Error collecting blob files")
+            fmt.Println(err)
+            continue
+        }
+        if len(dead) == 0 {
+            continue
+        }
+        previous := cf.FileManager.blobs
+        cf.FileManager.unregisterBlobs(dead)
+        err = fl.saveManifest()
+        if err != nil {
+            cf.FileManager.blobs = previous
+            cf.FileManager.sweptFiles = 0
+            fmt.Println("Error saving manifest")
+            fmt.Println(err)
+            return
+        }
+        cf.FileManager.removeBlobs(dead)
+    }
+}
+
+func (fl *FileDB) Family(name string) (*ColumnFamily, error) {
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    if cf, ok := fl.families[name]; ok {
+        return cf, nil
+    }
+    return nil, ErrColumnFamilyNotFound
+}
+
+func (fl *FileDB) Families() []string {
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    return sortedFamilyNames(fl.families)
+}
+
+func (fl *FileDB) CreateFamily(name string, opts *ColumnFamilyOptions) (*ColumnFamily, error) {
+    if fl.readOnly {
+        return nil, &ReadOnlyError{Op: "create family"}
+    }
+    if err := validateFamilyName(name); err != nil {
+        return nil, err
+    }
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    if _, ok := fl.families[name]; ok {
+        return nil, ErrColumnFamilyExists
+    }
+    if opts == nil {
+        opts = &ColumnFamilyOptions{CompactionTrigger: fl.options.CompactionTrigger}
+    }
+    cf, err := openColumnFamily(fl, name, *opts)
     if err != nil {
         return nil, err
     }
-    if v != nil {
-        return v, nil
+    fl.families[name] = cf
+    if err := fl.saveManifest(); err != nil {
+        delete(fl.families, name)
+        return nil, err
     }
-    return nil, nil
+    return cf, nil
 }
 
+// DropFamily removes a column family and all of its files. The WAL is flushed first
+// so that no record of the dropped family can be replayed into a later family of the same name.
+func (fl *FileDB) DropFamily(name string) error {
+    if fl.readOnly {
+        return &ReadOnlyError{Op: "drop family"}
+    }
+    if name == DefaultColumnFamily {
+        return errors.New("The default column family cannot be dropped")
+    }
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    cf, ok := fl.families[name]
+    if !ok {
+        return ErrColumnFamilyNotFound
+    }
+    if err := fl.flush(); err != nil {
+        return err
+    }
+    delete(fl.families, name)
+    if err := fl.saveManifest(); err != nil {
+        return err
+    }
+    return cf.FileManager.removeAll()
+}
 
+func (fl *FileDB) saveManifest() error {
+    return fl.manifest().save(fl.options.vfs(), fl.directory, fl.options.KeyProvider)
+}
 
-func (fl *FileDB) Del(key []byte) ([]byte, error) {
-    if v, err:=fl.exists(key); err != nil {
-        return nil, err
-    } else if v != nil {
-        fl.MemTable.Memdata[string(key)]=Entry{Key: string(key), Value: string(v), t: 1}
-        logSize:=2+len(key)+len(v)+1+1;
-        logEntry:=make([]byte, logSize)
-        binary.BigEndian.PutUint16(logEntry, uint16(len(key)+len(v)+2))
-        logEntry[2]=1
-        copy(logEntry[3:], key)
-        logEntry[len(key)+3]=61
-        copy(logEntry[len(key)+4:], v)
-        err:=fl.FileManager.Log(logEntry);
+// manifest describes the live files of every family.
+func (fl *FileDB) manifest() *Manifest {
+    m := &Manifest{LastSequence: fl.flushedSeq}
+    for _, name := range sortedFamilyNames(fl.families) {
+        cf := fl.families[name]
+        files := append(make([]*fileMeta, 0, len(cf.FileManager.files)), cf.FileManager.files...)
+        blobs := append([]*blobMeta{}, cf.FileManager.blobs...)
+        m.Families = append(m.Families, familyManifest{Name: name, Options: cf.Options, Files: files, Blobs: blobs})
+    }
+    return m
+}
+
+func sortedFamilyNames(families map[string]*ColumnFamily) []string {
+    names := make([]string, 0, len(families))
+    for name := range families {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// init validates the SST files of every family, applying the corruption policy to the bad
+// ones, and moves the content of the WAL left by the previous run into them.
+// A read-only database keeps the WAL content in its MemTables.
+func (fl *FileDB) init() error {
+    fl.mu.Lock()
+    defer fl.unlock()
+    quarantined := false
+    for _, name := range sortedFamilyNames(fl.families) {
+        cf := fl.families[name]
+        bad, err := cf.FileManager.init()
         if err != nil {
-            return nil, err
+            return err
+        }
+        if len(bad) == 0 {
+            continue
         }
-        if len(fl.MemTable.Memdata)>fl.CacheSize {
-            fl.FileManager.flushMem(fl.MemTable);
-            fl.MemTable.Memdata = make(map[string]Entry)
+        if err := fl.handleCorruption(cf, bad); err != nil {
+            return err
         }
-        return v, nil
+        quarantined = quarantined || fl.options.CorruptionPolicy == CorruptionQuarantine
+    }
+    if quarantined && !fl.readOnly {
+        if err := fl.saveManifest(); err != nil {
+            return err
+        }
+    }
+    if fl.wal == nil {
+        return nil
+    }
+    err := fl.wal.Replay(func(r walRecord) error {
+        if r.Sequence != 0 && r.Sequence <= fl.flushedSeq {
+            // the SST files hold it already: the log was not emptied durably after the
+            // flush, and newer values of its keys may have been flushed since
+            return nil
+        }
+        fl.apply(r.Batch)
+        if r.Sequence > fl.seq {
+            fl.seq = r.Sequence
+        }
+        return nil
+    })
+    if err != nil {
+        return errors.New("Error flushing log file")
     }
-    return nil, nil
+    if fl.readOnly {
+        return nil
+    }
+    return fl.flush()
 }
 
 func NewFileDB(f *FileManager) (*FileDB, error) {
-    MemTable:=&MemTable{
-        Memdata: make(map[string]Entry),
+    return newFileDB(f, DefaultOptions())
+}
+
+func newFileDB(f *FileManager, opts *Options) (*FileDB, error) {
+    var wal *WAL
+    var err error
+    if f.readOnly {
+        wal, err = openWALReadOnly(f.fs, f.logPath(), opts.KeyProvider)
+    } else {
+        wal, err = openWAL(f.fs, f.logPath(), opts.KeyProvider)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if wal != nil {
+        wal.sync = opts.SyncMode == SyncAlways
+        wal.archive = opts.WALArchiveDir
     }
-    return &FileDB{
+    blocks := NewBlockCache(opts.BlockCacheSize)
+    db := &FileDB{
         FileManager: f,
-        MemTable: MemTable,
-    }, nil
+        MaxEntrySize: opts.MaxEntrySize,
+        CacheSize: opts.MemTableSize,
+        directory: f.directory,
+        options: opts,
+        wal: wal,
+        families: make(map[string]*ColumnFamily),
+        blocks: blocks,
+        tables: NewTableCache(opts.MaxOpenFiles, blocks),
+        readOnly: f.readOnly,
+    }
+    db.tables.mmap = opts.UseMmap
+    db.tables.keys = opts.KeyProvider
+    db.tables.fs = f.fs
+    f.tables = db.tables
+    f.keys = opts.KeyProvider
+    manifest, err := loadManifest(f.fs, f.directory, opts.KeyProvider)
+    if err != nil {
+        return nil, err
+    }
+    db.seq = manifest.LastSequence
+    db.flushedSeq = manifest.LastSequence
+    var registered []*fileMeta
+    var blobs []*blobMeta
+    if fm := manifest.family(DefaultColumnFamily); fm != nil {
+        registered = fm.Files
+        blobs = fm.Blobs
+    }
+    err = f.load(registered)
+    if err != nil {
+        return nil, err
+    }
+    if err := f.loadBlobs(blobs); err != nil {
+        return nil, err
+    }
+    db.families[DefaultColumnFamily] = newColumnFamily(db, DefaultColumnFamily, f, ColumnFamilyOptions{CompactionTrigger: opts.CompactionTrigger})
+    for _, fm := range manifest.Families {
+        if fm.Name == DefaultColumnFamily {
+            continue
+        }
+        cf, err := openColumnFamily(db, fm.Name, fm.Options)
+        if err != nil {
+            return nil, err
+        }
+        err = cf.FileManager.load(fm.Files)
+        if err != nil {
+            return nil, err
+        }
+        if err := cf.FileManager.loadBlobs(fm.Blobs); err != nil {
+            return nil, err
+        }
+        db.families[fm.Name] = cf
+    }
+    db.MemTable = db.families[DefaultColumnFamily].MemTable
+    return db, nil
+}
+
+// Open opens the database stored in dir, creating it if needed, and recovers the WAL
+// left by the previous run. A nil opts uses DefaultOptions.
+// The directory is locked for the lifetime of the FileDB: opening a database that is
+// already open, in this process or another one, fails with ErrDatabaseLocked.
+func Open(dir string, opts *Options) (*FileDB, error) {
+    if opts == nil {
+        opts = DefaultOptions()
+    }
+    if err := opts.Validate(); err != nil {
+        return nil, err
+    }
+    lock, err := lockDirectory(opts.vfs(), dir)
+    if err != nil {
+        return nil, err
+    }
+    db, err := open(dir, opts)
+    if err != nil {
+        lock.Close()
+        return nil, err
+    }
+    db.lock = lock
+    return db, nil
+}
+
+func open(dir string, opts *Options) (*FileDB, error) {
+    f, err := newFileManager(opts.vfs(), dir)
+    if err != nil {
+        return nil, err
+    }
+    f.MaxFileSize = opts.MaxFileSize
+    f.SyncMode = opts.SyncMode
+    f.BlockSize = opts.BlockSize
+    f.RestartInterval = opts.BlockRestartInterval
+    f.Compression = opts.Compression
+    f.BlobThreshold = opts.BlobThreshold
+    f.BlobGCRatio = opts.BlobGCRatio
+    db, err := newFileDB(f, opts)
+    if err != nil {
+        return nil, err
+    }
+    err = db.init()
+    if err != nil {
+        db.release()
+        return nil, err
+    }
+    return db, nil
 }
 
+// OpenReadOnly opens an existing database for reads. It takes no lock and never writes, flushes
+// or compacts anything, so it is safe on a snapshot or next to a running server. When replayWAL
+// is set, the records of the WAL are replayed into memory, without truncating it.
+func OpenReadOnly(dir string, replayWAL bool) (*FileDB, error) {
+    return OpenReadOnlyWithOptions(dir, replayWAL, nil)
+}
+
+// OpenReadOnlyWithOptions is OpenReadOnly with the options of the database, such as its
+// KeyProvider. A nil opts uses DefaultOptions.
+func OpenReadOnlyWithOptions(dir string, replayWAL bool, opts *Options) (*FileDB, error) {
+    if opts == nil {
+        opts = DefaultOptions()
+    }
+    if err := opts.Validate(); err != nil {
+        return nil, err
+    }
+    info, err := opts.vfs().Stat(dir)
+    if err != nil {
+        return nil, err
+    }
+    if !info.IsDir() {
+        return nil, errors.New(dir + " is not a directory")
+    }
+    db, err := newFileDB(readOnlyFileManager(opts.vfs(), dir), opts)
+    if err != nil {
+        return nil, err
+    }
+    if !replayWAL && db.wal != nil {
+        db.wal.Close()
+        db.wal = nil
+    }
+    err = db.init()
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return db, nil
+}
+
+var ErrDatabaseLocked = errors.New("Database is already opened by another process")
+
+// lockDirectory takes an advisory lock on the LOCK file of the database directory.
+func lockDirectory(fs VFS, dir string) (io.Closer, error) {
+    err := fs.MkdirAll(dir, 0755)
+    if err != nil {
+        return nil, errors.New("Error creating directory")
+    }
+    lock, locked, err := fs.Lock(filepath.Join(dir, "LOCK"))
+    if err != nil {
+        return nil, fmt.Errorf("Error locking %s: %v", dir, err)
+    }
+    if !locked {
+        return nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, dir)
+    }
+    return lock, nil
+}
+
+// TableCacheStats reports the hits, misses and evictions of the table cache.
+func (fl *FileDB) TableCacheStats() TableCacheStats {
+    return fl.tables.Stats()
+}
+
+// BlockCacheStats reports the hits, misses and memory usage of the shared block cache.
+func (fl *FileDB) BlockCacheStats() BlockCacheStats {
+    return fl.blocks.Stats()
+}
+
+// Sync makes every write acknowledged so far durable, whatever the SyncMode.
+func (fl *FileDB) Sync() error {
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    if fl.closed {
+        return ErrClosed
+    }
+    if fl.readOnly || fl.wal == nil {
+        return nil
+    }
+    return fl.wal.file.Sync()
+}
+
+// Close flushes the MemTables into sealed SST files, so the next Open has no WAL to replay,
+// then closes the WAL and releases the directory lock. The FileDB cannot be used afterwards.
+func (fl *FileDB) Close() error {
+    fl.mu.Lock()
+    defer fl.mu.Unlock()
+    if fl.closed {
+        return ErrClosed
+    }
+    fl.closed = true
+    var err error
+    if !fl.readOnly {
+        err = fl.flush()
+    }
+    if releaseErr := fl.release(); err == nil {
+        err = releaseErr
+    }
+    return err
+}
+
+// release closes the WAL and the SST readers of the table cache, with their mappings, and
+// releases the directory lock. Close calls it once the MemTables are flushed, and a failed
+// Open calls it without flushing anything.
+func (fl *FileDB) release() error {
+    var err error
+    if fl.wal != nil {
+        err = fl.wal.Close()
+    }
+    fl.tables.Close()
+    if fl.lock != nil {
+        if unlockErr := fl.lock.Close(); err == nil {
+            err = unlockErr
+        }
+        fl.lock = nil
+    }
+    return err
+}
@@ -6,23 +6,23 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 
 
 /*
-The Filemanger class is responsible for managing the storage buckets (.sst files) and the log file.
-It provides methods to write to the log file and to the storage buckets. It also provides methods to read from the log file and the storage buckets.
-The Filemanager class also provides methods to flush the log file to the storage buckets and to compact the storage buckets.
+The Filemanger class is responsible for managing the storage buckets (.sst files) of one column family.
+It keeps the list of registered files, which the FileDB persists in the manifest, and provides methods to read from them.
+The Filemanager class also provides methods to flush a MemTable to the storage buckets and to compact the storage buckets.
+The log file is shared by all column families and handled by the WAL type.
 
 */
 type FileHeader interface {
@@ -34,78 +34,213 @@ type FileHeader interface {
 type FileManager struct{
 	directory string
 	fileheader FileHeader
-	WritePointer *os.File
-	logPointer *os.File
+	files []*fileMeta // registered SST files, oldest first
+	lastFileNumber int64
 	ReadPointer int64
 	MaxFileSize int64
+	CompactionTrigger int
+	TTL time.Duration
+	SyncMode SyncMode
+	BlockSize int
+	RestartInterval int
+	Compression []Codec
+	BlobThreshold int // values of at least this many bytes go to blob files, 0 keeps them in the SST files
+	BlobGCRatio float64 // share of garbage that makes a compaction copy the live values out of a blob file
+	blobs []*blobMeta // registered blob files, oldest first
+	sweptFiles int // SST files registered at the last blob sweep
+	tables *TableCache // shared with the other column families of the FileDB
+	keys KeyProvider // encrypts the SST files, nil writes them in plain text
+	fs VFS // filesystem of the directory
+	readOnly bool // never remove, seal or write files
 }
 
 
-func (fl *FileManager) init() error {
-	if fl.logPointer== nil{
-		log:=filepath.Join(fl.directory, "log")
-		file, err := os.OpenFile(log, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+func (fl *FileManager) init() ([]badFile, error) {
+	var bad []badFile
+	for _, meta := range fl.blobs {
+		if _, err := fl.fs.Stat(fl.blobPath(meta.Number)); err != nil {
+			return nil, fmt.Errorf("Missing blob file %s", meta.name())
+		}
+	}
+	for _, meta := range fl.files {
+		if _, err := fl.fs.Stat(fl.path(meta)); err != nil {
+			return nil, errors.New("Error opening file")
+		}
+		err := fl.checkFile(meta)
+		if errors.Is(err, ErrMissingKey) || errors.Is(err, ErrWrongKey) {
+			// the file is fine, the configuration is not
+			return nil, err
+		}
 		if err != nil {
-			return errors.New("Error opening log file")
+			bad = append(bad, badFile{meta: meta, err: err})
 		}
-		fl.logPointer=file
 	}
-	c:=make(chan bool)
-	go fl.flushLog(c)
-	test:=<-c
-	if test == false {
-		return errors.New("Error flushing log file")
+	return bad, nil
+}
+
+// checkFile is the startup check of a registered file. Files with block checksums only have
+// their footer, index and filter checked, data blocks are verified when they are read.
+func (fl *FileManager) checkFile(meta *fileMeta) error {
+	reader, err := openSSTReader(fl.fs, fl.path(meta), false, fl.keys)
+	if err != nil {
+		return err
+	}
+	version := reader.header.Version
+	reader.Close()
+	if version >= 5 {
+		return nil
 	}
-	directoryContent, err := ioutil.ReadDir(fl.directory)
+	file, err := fl.fs.Open(fl.path(meta))
+	if err != nil {
+		return errors.New("Error opening file")
+	}
+	defer file.Close()
+	return fl.ValidateFile(file)
+}
+
+/*
+load registers the SST files listed in the manifest and removes the ones left behind by an
+interrupted flush or compaction, which were never registered.
+Without a list (directories written before files were registered) every SST file of the
+directory is adopted instead.
+*/
+func (fl *FileManager) load(registered []*fileMeta) error {
+	files, err := fl.sstFiles()
 	if err != nil {
 		return errors.New("Error reading directory")
 	}
-	files:=make([]os.FileInfo, 0)
-	for _, file := range directoryContent {
-		if file.Name() == "log" {
-			continue
+	if registered == nil {
+		return fl.adopt(files)
+	}
+	known := make(map[string]bool)
+	for _, meta := range registered {
+		known[meta.Name] = true
+	}
+	for _, file := range files {
+		if !known[file.Name()] && !fl.readOnly {
+			fmt.Println("Removing unregistered file", file.Name())
+			fl.fs.Remove(filepath.Join(fl.directory, file.Name()))
 		}
-		files = append(files, file)
 	}
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() > files[j].Name()
+	fl.files = append([]*fileMeta{}, registered...)
+	sort.Slice(fl.files, func(i, j int) bool {
+		return fl.files[i].Name < fl.files[j].Name
 	})
-	files = files[1:]
-	for _, file := range files {
-		filePath := filepath.Join(fl.directory, file.Name())
-		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_APPEND, 0755)
+	for _, meta := range fl.files {
+		fl.noteFileNumber(meta.Name)
+	}
+	return nil
+}
+
+// adopt registers unlisted SST files. The newest one may be the unsealed file the previous
+// format kept open for writing: it is sealed first.
+func (fl *FileManager) adopt(files []os.FileInfo) error {
+	for i := len(files) - 1; i >= 0; i-- {
+		filePath := filepath.Join(fl.directory, files[i].Name())
+		if i == 0 && !fl.readOnly {
+			file, err := fl.fs.OpenFile(filePath, os.O_RDWR|os.O_APPEND, 0755)
+			if err != nil {
+				return errors.New("Error opening file")
+			}
+			if fl.ValidateFile(file) != nil {
+				err = fl.sealFile(file)
+			} else {
+				err = file.Close()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		reader, err := openSSTReader(fl.fs, filePath, false, fl.keys)
 		if err != nil {
-			return errors.New("Error opening file for writing")
+			return err
 		}
-		err = fl.ValidateFile(file)
+		mp := make(map[string]Entry)
+		err = reader.scan(func(e Entry) error {
+			mp[e.Key] = e
+			return nil
+		}, nil)
+		reader.Close()
 		if err != nil {
-			fmt.Println("Corrupted File Detected, cannot recover :(")
+			return err
+		}
+		if len(mp) == 0 {
+			if !fl.readOnly {
+				fl.fs.Remove(filePath)
+			}
+			continue
+		}
+		meta := &fileMeta{Name: files[i].Name(), Entries: len(mp)}
+		for key := range mp {
+			if meta.Smallest == nil || key < string(meta.Smallest) {
+				meta.Smallest = []byte(key)
+			}
+			if meta.Largest == nil || key > string(meta.Largest) {
+				meta.Largest = []byte(key)
+			}
 		}
+		if info, err := fl.fs.Stat(filePath); err == nil {
+			meta.Size = info.Size()
+		}
+		fl.files = append(fl.files, meta)
+		fl.noteFileNumber(meta.Name)
 	}
 	return nil
 }
 
-func (fl *FileManager) ValidateFile(file *os.File) error {
-	_, err := file.Seek(0, io.SeekStart)
+// sstFiles lists the SST files of the directory, newest first.
+func (fl *FileManager) sstFiles() ([]os.FileInfo, error) {
+	directoryContent, err := fl.fs.ReadDir(fl.directory)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	files:=make([]os.FileInfo, 0)
+	for _, file := range directoryContent {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".sst" {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() > files[j].Name()
+	})
+	return files, nil
+}
+
+/*
+ValidateFile checks the whole content of an SST file against its checksum: the CRC32C of the
+footer for version 5 files, the trailing md5 for older ones. The file is streamed rather
+than read into memory.
+*/
+func (fl *FileManager) ValidateFile(file File) error {
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return err
 	}
 	fileSize := fileInfo.Size()
+	header := NewSSTHeader()
+	if fileSize >= header.Size() && header.ReadHeader(file) == nil && header.Version >= 5 {
+		if fileSize < header.Size()+footerSize {
+			return errors.New("File is too small to validate")
+		}
+		footer := make([]byte, footerSize)
+		if _, err := file.ReadAt(footer, fileSize-footerSize); err != nil {
+			return err
+		}
+		hasher := crc32.New(castagnoli)
+		if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, fileSize-footerSize)); err != nil {
+			return err
+		}
+		if hasher.Sum32() != binary.BigEndian.Uint32(footer[32:]) || crc32.Checksum(footer[:36], castagnoli) != binary.BigEndian.Uint32(footer[36:]) {
+			return fmt.Errorf("%w: checksum mismatch in %s", ErrCorruption, file.Name())
+		}
+		return nil
+	}
 	if fileSize < 16 {
 		return errors.New("File is too small to validate")
 	}
-	buffer := make([]byte, fileSize-16)
-	_, err = file.Read(buffer)
-	if err != nil {
-		return err
-	}
 	hash := md5.New()
-	_, err = hash.Write(buffer)
-	if err != nil {
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, fileSize-16)); err != nil {
 		return err
 	}
 	calculatedHash := hex.EncodeToString(hash.Sum(nil))
@@ -123,283 +258,138 @@ func (fl *FileManager) ValidateFile(file *os.File) error {
 	return nil
 }
 
-func NewFileManager() (*FileManager, error) {
-	directory := "data"
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
-		err := os.Mkdir(directory, 0755)
+func NewFileManager(directory string) (*FileManager, error) {
+	return newFileManager(OSFS{}, directory)
+}
+
+func newFileManager(fs VFS, directory string) (*FileManager, error) {
+	if _, err := fs.Stat(directory); os.IsNotExist(err) {
+		err := fs.MkdirAll(directory, 0755)
 		if err != nil {
 			return nil, errors.New("Error creating directory")
 		}
 	}
-	f := FileManager{directory: directory}
-	d, err := os.Open(directory)
-	if err != nil {
-		return nil, errors.New("Error opening directory")
-	}
-	dircontent, err := d.Readdir(-1)
-	files:=make([]os.FileInfo, 0)
-	for _, file := range dircontent {
-		if file.Name() == "log" {
-			continue
-		}
-		files = append(files, file)
-	}
-	if err != nil {
-		return nil, errors.New("Error reading directory")
-	}
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() > files[j].Name()
-	})
-	var lastFile os.FileInfo
-	if len(files)>0{
-		lastFile = files[0]
-		filePath := filepath.Join(directory, lastFile.Name())
-		writePtr, err := os.OpenFile(filePath, os.O_RDWR|os.O_APPEND, 0755)
-		if err != nil {
-			return nil, errors.New("Error opening file for writing")
-		}
-		f.WritePointer = writePtr
-	}else{
-		newfile ,err := f.createNewFile()
-		if err != nil {
-			return nil, err
-		}
-		f.WritePointer = newfile
-	}
-	if err != nil {
-		return nil, errors.New("Error reading file info")
-	}
-	log:=filepath.Join(f.directory, "log")
-	file, err := os.OpenFile(log, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
-	if err != nil {
-		return nil,errors.New("Error opening log file")
-	}
-	f.logPointer=file
-	if err != nil {
-		return nil, errors.New("Error initializing file manager")
-	}
-
+	f := FileManager{directory: directory, fileheader: NewSSTHeader(), fs: fs}
 	return &f, nil
 }
 
-func (f *FileManager) Write(data []byte) error {
-	if f.WritePointer == nil {
-		fmt.Println("Write pointer is nil")
-		newfile, err := f.createNewFile()
-		if err != nil {
-			fmt.Println("Error creating new file")
-			return err
-		}
-		f.WritePointer = newfile
-	}
-	_, err := f.WritePointer.Write(data)
-	return err
+// readOnlyFileManager opens an existing directory without creating or modifying anything in it.
+func readOnlyFileManager(fs VFS, directory string) *FileManager {
+	return &FileManager{directory: directory, fileheader: NewSSTHeader(), fs: fs, readOnly: true}
 }
 
-
-func (f *FileManager) createNewFile() (*os.File,error) {
-	filePath := filepath.Join(f.directory, strconv.FormatInt(time.Now().UnixNano(), 10))
-	filePath = filePath + ".sst"
-	file, err := os.Create(filePath)
-	if err != nil {
-		fmt.Println("Error creating new file 1")
-		return nil,err
+// syncDirectory makes the creation of the files just written durable, unless SyncMode is SyncNone.
+func (f *FileManager) syncDirectory() error {
+	if f.SyncMode == SyncNone {
+		return nil
 	}
-	if err := f.writeHeader(file); err != nil {
-		fmt.Println("Error writing header")
-		return nil,err
-	}
-	return file,nil
+	return f.fs.SyncDir(f.directory)
 }
 
-func (f *FileManager) writeHeader(file *os.File) error {
-	header:=NewSSTHeader()
-	header.Timestamp=time.Now()
-	header.Version=1
-	header.size=50
-	err:=header.WriteHeader(file);
-	return err
+func (f *FileManager) logPath() string {
+	return filepath.Join(f.directory, "log")
 }
 
+func (f *FileManager) path(meta *fileMeta) string {
+	return filepath.Join(f.directory, meta.Name)
+}
 
+// nextFileName names SST files after their creation time, kept strictly increasing so
+// that name order is also the order in which files were written.
+func (f *FileManager) nextFileName() string {
+	return strconv.FormatUint(f.nextFileNumber(), 10) + ".sst"
+}
 
-func (f *FileManager) Log(logRecord []byte) (error){
-	directory := f.directory
-	if f.logPointer == nil {
-		log:=filepath.Join(directory, "log")
-		file, err := os.OpenFile(log, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
-		if err != nil {
-			return errors.New("Error opening log file")
-		}
-		f.logPointer=file
-	}
-	_ , err:=f.logPointer.Write(logRecord)
-	if err != nil {
-		fmt.Println("Error writing to log file")
-		return err
+// nextFileNumber numbers SST and blob files from the same sequence.
+func (f *FileManager) nextFileNumber() uint64 {
+	n := time.Now().UnixNano()
+	if n <= f.lastFileNumber {
+		n = f.lastFileNumber + 1
+	}
+	f.lastFileNumber = n
+	return uint64(n)
+}
+
+func (f *FileManager) noteFileNumber(name string) {
+	n, err := strconv.ParseInt(strings.TrimSuffix(name, filepath.Ext(name)), 10, 64)
+	if err == nil && n > f.lastFileNumber {
+		f.lastFileNumber = n
 	}
-	return nil
 }
 
-func (f *FileManager)Read()(map[string]Entry, error) {
-    header := f.fileheader
-    err := header.ReadHeader(f.WritePointer)
-    if err != nil {
-        fmt.Println("Error reading header")
-        return nil, err
-    }
-    offset := header.Size()
-    mp := make(map[string]Entry)
-    fileInfo, err := f.WritePointer.Stat()
-    if err != nil {
-        return nil, err
-    }
-    for offset < fileInfo.Size(){
-        if offset+2 > fileInfo.Size() {
-            break
-        }
-        entrySizeBytes := make([]byte, 2)
-        _, err := f.WritePointer.ReadAt(entrySizeBytes, offset)
-        if err != nil {
-            fmt.Println("Error reading entry size")
-            return nil, err
-        }
-        entrySize := binary.BigEndian.Uint16(entrySizeBytes)
-        if offset+2+int64(entrySize) > fileInfo.Size() {
-            break
-        }
-        entryData := make([]byte, entrySize)
-        _, err = f.WritePointer.ReadAt(entryData, offset+2)
-        if err != nil {
-            fmt.Println("Error reading entry data")
-            return nil, err
-        }
-        entryType := entryData[0]
-        entryData = entryData[1:]
-        s := string(entryData)
-        split := strings.Split(s, "=")
-        if entryType == 0 {
-			mp[split[0]] = Entry{Key:split[0],Value:split[1],t:0}
-        }else{
-			mp[split[0]] = Entry{Key:split[0],Value:split[1],t:1}
-		}
-        offset += int64(entrySize) + 2
-    }
-    return mp, nil
+// expired reports whether an SST file last modified at modTime is older than the TTL of its column family.
+func (f *FileManager) expired(modTime time.Time) bool {
+	return f.TTL > 0 && time.Since(modTime) > f.TTL
 }
 
+// reader returns the open reader of a registered file from the table cache, it must be closed after use.
+func (f *FileManager) reader(meta *fileMeta) (*sstReader, error) {
+	return f.tables.get(f.path(meta))
+}
 
-func (f *FileManager) loadFile(filetoLoad *os.File) (map[string]Entry, error) {
-    header := f.fileheader
-    err := header.ReadHeader(filetoLoad)
-    if err != nil {
-        fmt.Println("Error reading header")
-        return nil, err
-    }
-    offset := header.Size()
-    mp := make(map[string]Entry)
-    checksumSize := int64(16)
-	fileInfo, err := filetoLoad.Stat()
-	if err != nil {
-		return nil, err
+// removeAll deletes the directory of a dropped column family.
+func (f *FileManager) removeAll() error {
+	for _, meta := range f.files {
+		f.tables.evict(f.path(meta))
 	}
-    for offset < fileInfo.Size()-checksumSize{
-        entrySizeBytes := make([]byte, 2)
-        _, err := filetoLoad.ReadAt(entrySizeBytes, offset)
-        if err != nil {
-            if err == io.EOF {
-                break
-            }
-            fmt.Println("Error reading entry size")
-            return nil, err
-        }
-        entrySize := binary.BigEndian.Uint16(entrySizeBytes)
-        entryData := make([]byte, entrySize)
-        _, err = filetoLoad.ReadAt(entryData, offset+2)
-        if err != nil {
-            fmt.Println("Error reading entry data")
-            return nil, err
-        }
-		entryType := entryData[0]
-		entryData = entryData[1:]
-		s := string(entryData)
-		split := strings.Split(s, "=")
-		if entryType == 0 {
-			mp[split[0]] = Entry{Key:split[0],
-				Value:split[1],t:0}
-		}else{
-			mp[split[0]] = Entry{Key:split[0],Value:split[1],t:1}
-		}
-        offset += int64(entrySize) +2  
-    }
-    return mp, nil
+	f.files = nil
+	return f.fs.RemoveAll(f.directory)
 }
 
-
-func (f *FileManager) flushLog(c chan<- bool) error {
-	logInfo, err := f.logPointer.Stat()
-	if err != nil {
-		fmt.Println("Error reading log file")
-		fmt.Println(err)	
-		c<-false
-		return err
+// removeFiles deletes files that are no longer registered.
+func (f *FileManager) removeFiles(metas []*fileMeta) {
+	for _, meta := range metas {
+		f.tables.evict(f.path(meta))
+		err := f.fs.Remove(f.path(meta))
+		if err != nil {
+			fmt.Println("Error removing file", meta.Name)
+		}
 	}
-	logsize:=logInfo.Size()
-    logcontent := make([]byte, logsize)
-    _, err = f.logPointer.ReadAt(logcontent, 0)
-    if err != nil {
-		fmt.Println("Error read content of the  log file")
-		fmt.Println(err)
-		c<-false
-        return err
-    }
-    if err != nil {
-		fmt.Println("Error obtaining lock for log file")
-		c<-false
-        return err
-    }
-    err =f.Write(logcontent)
-    if err != nil {
-		fmt.Println("Error writing to SST file")
-		fmt.Println(err)
-		c<-false
-        return err
-    }
-	logmutex:=sync.Mutex{}
-	logmutex.Lock()
-	err=f.logPointer.Close()
-	if(err!=nil){
-		fmt.Println("Error closing log file")
-		fmt.Println(err)
-		c<-false
-		return err
+}
+
+func (f *FileManager) writeHeader(w io.Writer, codec Codec, enc *encryptor) error {
+	header:=NewSSTHeader()
+	header.magic=sstMagic
+	header.Codec=codec
+	if enc != nil {
+		header.KeyID = enc.id
+		header.KeyCheck = enc.check
 	}
-	err = os.Truncate(f.logPointer.Name(), 0)
-	f.logPointer ,err = os.OpenFile(f.logPointer.Name(), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
-	if err != nil {
-		fmt.Println("Error recreating the  log file")
-		fmt.Println(err)
-		c<-false
-		return err
+	header.Timestamp=time.Now()
+	header.Version=sstVersion
+	header.size=50
+	err:=header.WriteHeader(w);
+	return err
+}
+
+// codec returns the compression of the files written at level.
+func (f *FileManager) codec(level int) Codec {
+	if len(f.Compression) == 0 {
+		return CodecNone
 	}
-	logmutex.Unlock()
-	if(err!=nil){
-		fmt.Println("Error truncating log file")
-		fmt.Println(err)
-		c<-false
-		return err
+	if level >= len(f.Compression) {
+		level = len(f.Compression) - 1
 	}
-	c<-true
-    return nil
+	return f.Compression[level]
+}
+
+// iterator walks the registered files newest first, skipping those whose key range
+// cannot contain key.
+func (f *FileManager) iterator(key []byte) *DirectoryIterator {
+	return &DirectoryIterator{files: f.files, pos: len(f.files), key: key}
 }
 
-func (f *FileManager) closeFile() error{
-	fileInfo, err := f.WritePointer.Stat()
+
+// sealFile appends the md5 checksum of the whole file and closes it. Only adopt uses it, for
+// the version 1 file the original format kept open for writing; later files are finished by
+// sstWriter.
+func (f *FileManager) sealFile(file File) error{
+	fileInfo, err := file.Stat()
 	if err != nil {
 		return err
 	}
 	fileContent := make([]byte, fileInfo.Size())
-	_,err=f.WritePointer.ReadAt(fileContent, 0)
+	_,err=file.ReadAt(fileContent, 0)
 	if err != nil {
 		fmt.Println("Error reading file content")
 		return err
@@ -407,94 +397,187 @@ func (f *FileManager) closeFile() error{
 	hasher := md5.New()
 	hasher.Write(fileContent)
 	hash := hasher.Sum(nil)
-	logMutes:=sync.Mutex{}
-	logMutes.Lock()
-	_,err=f.WritePointer.Write(hash)
+	_,err=file.Write(hash)
 	if err != nil {
 		fmt.Println("Error writing hash")
 		return err
 	}
-	logMutes.Unlock()
-	f.WritePointer.Close()
-	return nil
+	if f.SyncMode != SyncNone {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
 }
 
-func (f *FileManager) compact() error {
-    // Get a list of SST files in the directory
-    files, err := ioutil.ReadDir(f.directory)
+var compactionReadOptions = &ReadOptions{DontFillCache: true, VerifyChecksums: true}
+
+/*
+compact merges every registered file into new level 1 files once more than CompactionTrigger
+level 0 files have been flushed. Files older than TTL are dropped instead of merged.
+Tombstones are discarded since no older file survives the compaction.
+The merged files keep the modification time of the newest input so TTL still sees the
+data at its original age.
+compact returns the files it replaced and the blob files no longer referenced; they must be
+removed once the new lists are registered. Values of blob files past BlobGCRatio of garbage
+are copied into a new blob file on the way.
+Its reads bypass the block cache so they do not evict the blocks of point lookups.
+The blob files mem, the MemTable of the family, still refers to are kept as they are.
+*/
+func (f *FileManager) compact(mem *MemTable) ([]*fileMeta, []*blobMeta, error) {
+    level0 := 0
+    for _, meta := range f.files {
+        if meta.Level == 0 {
+            level0++
+        }
+    }
+    if f.CompactionTrigger <= 0 || level0 <= f.CompactionTrigger {
+        return nil, nil, nil
+    }
+    globalMap, newest, err := f.liveEntries()
     if err != nil {
-        return err
+        return nil, nil, err
     }
-    sstFiles := []os.FileInfo{}
-    for _, file := range files {
-        if strings.HasSuffix(file.Name(), ".sst") {
-            sstFiles = append(sstFiles, file)
-        }
+    relocate, referenced, err := f.collectBlobGarbage(globalMap, mem.Memdata)
+    if err != nil {
+        return nil, nil, err
     }
-    if len(sstFiles) <= 10 {
-        return nil
+    w := f.newSSTWriter(1)
+    blobs := f.newBlobWriter()
+    abort := func() {
+        w.Abort()
+        blobs.abort()
     }
-    globalMap := make(map[string]Entry)
-    for _, file := range sstFiles {
-        filePath := filepath.Join(f.directory, file.Name())
-		fileToCompact, err := os.Open(filePath)
-		if err != nil {
-			return err
-		}
-        fileMap, err := f.loadFile(fileToCompact)
-        if err != nil {
-            return err
+    for _, key := range sortedKeys(globalMap) {
+        entry := globalMap[key]
+        if entry.t == blobEntryType {
+            p, _ := decodeBlobPointer(entry.Value)
+            if relocate[p.file] {
+                value, err := f.readBlob(entry.Value, compactionReadOptions)
+                if err == nil {
+                    p, err = blobs.add(key, value)
+                }
+                if err != nil {
+                    abort()
+                    return nil, nil, err
+                }
+                entry.Value = p.encode()
+            }
         }
-        for _, entry := range fileMap {
-			if entry.t == 0 {
-				globalMap[entry.Key] = entry
-			}else{
-				delete(globalMap, entry.Key)
-			}
+        entry, err = blobs.separate(entry)
+        if err == nil {
+            err = w.Add(entry)
+        }
+        if err != nil {
+            abort()
+            return nil, nil, err
         }
     }
-    compactedFile, err := f.createNewFile()
+    outputs, err := w.Finish()
     if err != nil {
-        return err
+        abort()
+        return nil, nil, err
     }
-    defer compactedFile.Close()
-	buffer:=make([]byte, 0)
-    for _, entry := range globalMap {
-        entryBytes := entry.toBytes()
-		buffer=append(buffer, entryBytes...)
-    }
-    _, err = compactedFile.Write(buffer)
+    blob, err := blobs.finish()
     if err != nil {
-        return err
+        abort()
+        return nil, nil, err
     }
-    compactedFile.Close()
-    for _, file := range sstFiles {
-        err := os.Remove(filepath.Join(f.directory, file.Name()))
+    for _, meta := range outputs {
+        err := f.fs.Chtimes(f.path(meta), newest, newest)
         if err != nil {
-            return err
+            abort()
+            return nil, nil, err
+        }
+    }
+    var kept, obsoleteBlobs []*blobMeta
+    for _, meta := range f.blobs {
+        if relocate[meta.Number] || !referenced[meta.Number] {
+            obsoleteBlobs = append(obsoleteBlobs, meta)
+        } else {
+            kept = append(kept, meta)
         }
     }
-    return nil
+    if blob != nil {
+        kept = append(kept, blob)
+    }
+    obsolete := f.files
+    f.files = outputs
+    f.blobs = kept
+    return obsolete, obsoleteBlobs, nil
 }
 
+// liveEntries merges the files that have not expired, oldest first so newer entries overwrite
+// older ones, and returns the newest entry of every live key with the time of the newest file.
+func (f *FileManager) liveEntries() (map[string]Entry, time.Time, error) {
+    globalMap := make(map[string]Entry)
+    var newest time.Time
+    for _, meta := range f.files {
+        reader, err := f.reader(meta)
+        if err != nil {
+            return nil, newest, err
+        }
+        if f.expired(reader.modTime) {
+            reader.Close()
+            continue
+        }
+        if reader.modTime.After(newest) {
+            newest = reader.modTime
+        }
+        err = reader.scan(func(entry Entry) error {
+            if entry.t != 1 {
+                globalMap[entry.Key] = entry
+            } else {
+                delete(globalMap, entry.Key)
+            }
+            return nil
+        }, compactionReadOptions)
+        reader.Close()
+        if err != nil {
+            return nil, newest, err
+        }
+    }
+    return globalMap, newest, nil
+}
+
+// flushMem writes the MemTable in key order as level 0 files, rolling over to a new file
+// whenever MaxFileSize is reached, and registers them.
 func (f *FileManager) flushMem(mem *MemTable) error {
-	buffer:=make([]byte, 0)
-	for _, v := range mem.Memdata {
-		entry:=v.toBytes()
-		buffer=append(buffer, entry...)
-	}
-	f.Write(buffer)
-	f.closeFile()
-	//f.compact()	
-	newFile,err:=f.createNewFile()
-	if err != nil {
-		return err
+	w := f.newSSTWriter(0)
+	blobs := f.newBlobWriter()
+	for _, key := range sortedKeys(mem.Memdata) {
+		entry, err := blobs.separate(mem.Memdata[key])
+		if err == nil {
+			err = w.Add(entry)
+		}
+		if err != nil {
+			w.Abort()
+			blobs.abort()
+			return err
+		}
+	}
+	outputs, err := w.Finish()
+	if err == nil {
+		var blob *blobMeta
+		if blob, err = blobs.finish(); blob != nil {
+			f.blobs = append(f.blobs, blob)
+		}
 	}
-	f.WritePointer=newFile
-	err = os.Truncate(f.logPointer.Name(), 0)
-	f.logPointer ,err = os.OpenFile(f.logPointer.Name(), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
-		return errors.New("Error recreating the log file")
+		w.Abort()
+		blobs.abort()
+		return err
 	}
+	f.files = append(f.files, outputs...)
 	return nil
 }
+
+func sortedKeys(entries map[string]Entry) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+/*
+A bloomFilter answers "is this key possibly in the file" without reading any data block.
+It is built once per SST file with bloomBitsPerKey bits per key; the last byte stores the
+number of probes. False positives are possible, false negatives are not.
+*/
+
+const bloomBitsPerKey = 10
+
+type bloomFilter []byte
+
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func newBloomFilter(keys [][]byte) bloomFilter {
+	bits := len(keys) * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+	// ln(2) * bits per key minimizes the false positive rate
+	probes := bloomBitsPerKey * 69 / 100
+	filter := make(bloomFilter, bytes+1)
+	filter[bytes] = byte(probes)
+	for _, key := range keys {
+		h1, h2 := bloomHash(key)
+		for i := 0; i < probes; i++ {
+			bit := (h1 + uint32(i)*h2) % uint32(bits)
+			filter[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return filter
+}
+
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	probes := int(f[len(f)-1])
+	h1, h2 := bloomHash(key)
+	for i := 0; i < probes; i++ {
+		bit := (h1 + uint32(i)*h2) % bits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+Bulk loads skip the WAL and the MemTable: an SSTWriter builds a complete SST file offline
+from keys given in increasing order, and IngestFiles adds such files to a column family in
+one manifest update. The ingested files must not overlap each other; they are newer than
+everything already in the family, so their keys replace older values, and a MemTable holding
+keys of their ranges is flushed first so it cannot shadow them.
+Ingested data is not in the WAL, a point-in-time recovery needs a base taken after the ingestion.
+*/
+
+var ErrOverlappingFiles = errors.New("Ingested files overlap")
+
+// SSTWriter writes a single SST file with the block size, restart interval, compression and
+// maximum entry size of opts.
+type SSTWriter struct {
+	w            *sstWriter
+	path         string
+	maxEntrySize int
+	entries      int
+}
+
+type SSTFileInfo struct {
+	Path     string
+	Smallest []byte
+	Largest  []byte
+	Entries  int
+	Size     int64
+}
+
+// NewSSTWriter starts the file path, which must not exist. A nil opts uses DefaultOptions,
+// files for an encrypted database need its KeyProvider in opts, and the file is written to
+// opts.FS, where IngestFiles of a database on that filesystem reads it.
+func NewSSTWriter(path string, opts *Options) (*SSTWriter, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := opts.vfs().Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	f := &FileManager{
+		fs:              opts.vfs(),
+		directory:       filepath.Dir(path),
+		fileheader:      NewSSTHeader(),
+		keys:            opts.KeyProvider,
+		SyncMode:        opts.SyncMode,
+		BlockSize:       opts.BlockSize,
+		RestartInterval: opts.BlockRestartInterval,
+		Compression:     opts.Compression,
+	}
+	// written under a temporary name so a half written file is never taken for a finished one
+	w := f.newSSTWriter(0)
+	w.name = filepath.Base(path) + ".tmp"
+	return &SSTWriter{w: w, path: path, maxEntrySize: opts.MaxEntrySize}, nil
+}
+
+func (s *SSTWriter) add(e Entry) error {
+	if len(e.Key) == 0 {
+		return errors.New("Key cannot be empty")
+	}
+	if len(e.Key)+len(e.Value)+1 > s.maxEntrySize {
+		return errors.New("Entry size too large")
+	}
+	if err := s.w.Add(e); err != nil {
+		return err
+	}
+	s.entries++
+	return nil
+}
+
+// Put adds a value, keys must be given in strictly increasing order.
+func (s *SSTWriter) Put(key, value []byte) error {
+	return s.add(Entry{Key: string(key), Value: string(value)})
+}
+
+// Delete adds a tombstone hiding the older values of key once the file is ingested.
+func (s *SSTWriter) Delete(key []byte) error {
+	return s.add(Entry{Key: string(key), t: 1})
+}
+
+// Finish completes the file and moves it to its path.
+func (s *SSTWriter) Finish() (*SSTFileInfo, error) {
+	if s.entries == 0 {
+		s.Abort()
+		return nil, errors.New("Cannot write an SST file without entries")
+	}
+	outputs, err := s.w.Finish()
+	if err != nil {
+		s.Abort()
+		return nil, err
+	}
+	meta := outputs[0]
+	if err := s.w.f.fs.Rename(s.w.f.path(meta), s.path); err != nil {
+		s.Abort()
+		return nil, err
+	}
+	return &SSTFileInfo{Path: s.path, Smallest: meta.Smallest, Largest: meta.Largest, Entries: meta.Entries, Size: meta.Size}, nil
+}
+
+// Abort removes the unfinished file.
+func (s *SSTWriter) Abort() {
+	s.w.Abort()
+}
+
+// inspectSST checks an SST file to ingest: its checksums and the order of its keys. It
+// returns the metadata it will be registered with. An encrypted database only takes files
+// encrypted with one of its keys.
+func inspectSST(fs VFS, path string, keys KeyProvider) (*fileMeta, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = (&FileManager{}).ValidateFile(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	reader, err := openSSTReader(fs, path, false, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer reader.Close()
+	if reader.header.Version != sstVersion {
+		return nil, fmt.Errorf("%s: version %d files cannot be ingested, write them with SSTWriter", path, reader.header.Version)
+	}
+	if keys != nil && reader.enc == nil {
+		return nil, fmt.Errorf("%s: the database is encrypted, write the file with its KeyProvider", path)
+	}
+	meta := &fileMeta{Size: reader.size}
+	err = reader.scan(func(e Entry) error {
+		if e.t == blobEntryType {
+			return fmt.Errorf("%s: files referring to blob files cannot be ingested", path)
+		}
+		key := []byte(e.Key)
+		if meta.Entries > 0 && bytes.Compare(key, meta.Largest) <= 0 {
+			return fmt.Errorf("%s: keys are not in increasing order at %q", path, e.Key)
+		}
+		if meta.Entries == 0 {
+			meta.Smallest = key
+		}
+		meta.Largest = key
+		meta.Entries++
+		return nil
+	}, scanReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Entries == 0 {
+		return nil, fmt.Errorf("%s: no entries", path)
+	}
+	return meta, nil
+}
+
+// IngestFiles adds SST files written by SSTWriter to the default column family.
+func (fl *FileDB) IngestFiles(paths []string) error {
+	return fl.families[DefaultColumnFamily].IngestFiles(paths)
+}
+
+// IngestFiles adds SST files written by SSTWriter to the family. They are hard-linked, or
+// copied across filesystems, so the originals can be removed afterwards. Either every file
+// is registered or none is.
+func (cf *ColumnFamily) IngestFiles(paths []string) error {
+	if cf.db.readOnly {
+		return &ReadOnlyError{Op: "ingest"}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	// the files are checked before taking the lock, reading them can take a while
+	metas := make([]*fileMeta, len(paths))
+	for i, path := range paths {
+		meta, err := inspectSST(cf.FileManager.fs, path, cf.FileManager.keys)
+		if err != nil {
+			return err
+		}
+		metas[i] = meta
+	}
+	order := make([]int, len(paths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(metas[order[i]].Smallest, metas[order[j]].Smallest) < 0
+	})
+	for i := 1; i < len(order); i++ {
+		prev, next := metas[order[i-1]], metas[order[i]]
+		if bytes.Compare(next.Smallest, prev.Largest) <= 0 {
+			return fmt.Errorf("%w: %s and %s", ErrOverlappingFiles, paths[order[i-1]], paths[order[i]])
+		}
+	}
+
+	db := cf.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	for key := range cf.MemTable.Memdata {
+		if overlapsAny(metas, []byte(key)) {
+			if err := db.flush(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	f := cf.FileManager
+	now := time.Now()
+	var linked []*fileMeta
+	rollback := func() {
+		for _, meta := range linked {
+			f.fs.Remove(f.path(meta))
+		}
+	}
+	for i, path := range paths {
+		meta := metas[i]
+		meta.Name = f.nextFileName()
+		if err := linkOrCopy(f.fs, path, f.path(meta)); err != nil {
+			rollback()
+			return err
+		}
+		linked = append(linked, meta)
+		// the data is as old as the ingestion for the TTL
+		if err := f.fs.Chtimes(f.path(meta), now, now); err != nil {
+			rollback()
+			return err
+		}
+	}
+	if err := f.fs.SyncDir(f.directory); err != nil {
+		rollback()
+		return err
+	}
+	previous := f.files
+	f.files = append(append([]*fileMeta{}, f.files...), linked...)
+	if err := db.saveManifest(); err != nil {
+		f.files = previous
+		rollback()
+		return err
+	}
+	db.compact()
+	return nil
+}
+
+func overlapsAny(metas []*fileMeta, key []byte) bool {
+	for _, meta := range metas {
+		if meta.contains(key) {
+			return true
+		}
+	}
+	return false
+}
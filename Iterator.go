@@ -0,0 +1,245 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+/*
+An Iterator walks the live keys of a column family in key order without loading them all:
+it merges the SST files overlapping its range, one block at a time, with a sorted copy of
+the MemTable entries of the range. Creating it is the only step holding the database lock:
+the readers of the files and the registered blob files are pinned then, so flushes and
+compactions running meanwhile neither close nor delete what it reads, and it sees the
+family as it was at that moment. Blob values are resolved one entry at a time, as Next
+returns them. An Iterator must be closed.
+*/
+
+type iterSource struct {
+	reader  *sstReader // nil for the MemTable
+	meta    *fileMeta
+	age     int // newer sources win on equal keys
+	block   int // next block to load
+	entries []Entry
+	pos     int
+}
+
+type Iterator struct {
+	cf      *ColumnFamily
+	start   []byte
+	end     []byte
+	sources iterHeap
+	readers []*iterSource
+	blobs   map[uint64]File
+	started bool
+	err     error
+}
+
+// NewIterator returns an iterator over the live keys of cf in [start, end), a nil end meaning
+// no upper bound.
+func (cf *ColumnFamily) NewIterator(start, end []byte) (*Iterator, error) {
+	db := cf.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	it := &Iterator{cf: cf, start: start, end: end, blobs: make(map[uint64]File)}
+	for age, meta := range cf.FileManager.files {
+		if string(meta.Largest) < string(start) || (end != nil && string(meta.Smallest) >= string(end)) {
+			continue
+		}
+		reader, err := cf.FileManager.reader(meta)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		if cf.FileManager.expired(reader.modTime) {
+			reader.Close()
+			continue
+		}
+		it.readers = append(it.readers, &iterSource{reader: reader, meta: meta, age: age, block: reader.seek(start)})
+	}
+	for _, meta := range cf.FileManager.blobs {
+		file, err := cf.FileManager.fs.Open(cf.FileManager.blobPath(meta.Number))
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.blobs[meta.Number] = file
+	}
+	mem := &iterSource{age: len(cf.FileManager.files)}
+	for key, e := range cf.MemTable.Memdata {
+		if it.inRange(key) {
+			mem.entries = append(mem.entries, e)
+		}
+	}
+	sort.Slice(mem.entries, func(i, j int) bool {
+		return mem.entries[i].Key < mem.entries[j].Key
+	})
+	it.push(mem)
+	return it, nil
+}
+
+func (it *Iterator) inRange(key string) bool {
+	return key >= string(it.start) && (it.end == nil || key < string(it.end))
+}
+
+// push adds a source to the heap once it has an entry at or after start, loading its blocks
+// as needed. Sources without one are dropped.
+func (it *Iterator) push(s *iterSource) error {
+	for {
+		for s.pos < len(s.entries) && s.entries[s.pos].Key < string(it.start) {
+			s.pos++
+		}
+		if s.pos < len(s.entries) {
+			heap.Push(&it.sources, s)
+			return nil
+		}
+		if s.reader == nil || s.block >= len(s.reader.index) {
+			return nil
+		}
+		entries, err := s.reader.readBlock(s.block, scanReadOptions)
+		if err != nil {
+			return it.corruption(s, err)
+		}
+		if s.reader.header.Version < 2 {
+			entries = sortLegacyBlock(entries)
+		}
+		s.block++
+		s.entries, s.pos = entries, 0
+	}
+}
+
+func (it *Iterator) corruption(s *iterSource, err error) error {
+	if errors.Is(err, ErrCorruption) {
+		db := it.cf.db
+		db.mu.Lock()
+		db.reportCorruption(it.cf, s.meta, "reported", err)
+		db.unlock()
+	}
+	return err
+}
+
+// sortLegacyBlock sorts the records of a version 1 file, which may hold a key several times,
+// keeping the last record of each key.
+func sortLegacyBlock(entries []Entry) []Entry {
+	sorted := append([]Entry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	var unique []Entry
+	for i, e := range sorted {
+		if i+1 < len(sorted) && sorted[i+1].Key == e.Key {
+			continue
+		}
+		unique = append(unique, e)
+	}
+	return unique
+}
+
+// Next returns the next live key and its value, io.EOF once the range is exhausted.
+func (it *Iterator) Next() ([]byte, []byte, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+	if !it.started {
+		// the first blocks are read here rather than in NewIterator, without the lock
+		it.started = true
+		for _, s := range it.readers {
+			if err := it.push(s); err != nil {
+				it.err = err
+				return nil, nil, err
+			}
+		}
+	}
+	for len(it.sources) > 0 {
+		top := it.sources[0]
+		e := top.entries[top.pos]
+		if !it.inRange(e.Key) {
+			// every source is past end
+			break
+		}
+		// the newest source is on top, the older records of the key are skipped
+		for len(it.sources) > 0 && it.sources[0].entries[it.sources[0].pos].Key == e.Key {
+			s := heap.Pop(&it.sources).(*iterSource)
+			s.pos++
+			if err := it.push(s); err != nil {
+				it.err = err
+				return nil, nil, err
+			}
+		}
+		if e.t == 1 {
+			continue
+		}
+		value, err := it.resolve(e)
+		if err != nil {
+			if errors.Is(err, ErrCorruption) && top.meta != nil {
+				it.corruption(top, err)
+			}
+			it.err = err
+			return nil, nil, err
+		}
+		return []byte(e.Key), []byte(value), nil
+	}
+	it.err = io.EOF
+	return nil, nil, io.EOF
+}
+
+// resolve returns the value of an entry, read from its pinned blob file for blob entries.
+func (it *Iterator) resolve(e Entry) (string, error) {
+	if e.t != blobEntryType {
+		return e.Value, nil
+	}
+	p, err := decodeBlobPointer(e.Value)
+	if err != nil {
+		return "", err
+	}
+	file, ok := it.blobs[p.file]
+	if !ok {
+		return "", fmt.Errorf("%w: blob file %d is not registered", ErrCorruption, p.file)
+	}
+	return readBlobValue(file, p, scanReadOptions)
+}
+
+// Close releases the pinned readers and blob files.
+func (it *Iterator) Close() error {
+	for _, s := range it.readers {
+		s.reader.Close()
+	}
+	for _, file := range it.blobs {
+		file.Close()
+	}
+	it.readers, it.blobs, it.sources = nil, nil, nil
+	if it.err == nil {
+		it.err = ErrClosed
+	}
+	return nil
+}
+
+// iterHeap orders the sources by their current key, the newest first on equal keys.
+type iterHeap []*iterSource
+
+func (h iterHeap) Len() int { return len(h) }
+
+func (h iterHeap) Less(i, j int) bool {
+	a, b := h[i].entries[h[i].pos].Key, h[j].entries[h[j].pos].Key
+	if a != b {
+		return a < b
+	}
+	return h[i].age > h[j].age
+}
+
+func (h iterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *iterHeap) Push(x any) { *h = append(*h, x.(*iterSource)) }
+
+func (h *iterHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
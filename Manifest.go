@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+The Manifest is the persistent description of a database directory: the column families
+it hosts, their options and the SST files registered in each of them. An SST file only
+becomes part of the database once a manifest listing it has been saved.
+It is stored as JSON in the MANIFEST file and always replaced atomically (write to a
+temporary file, sync, rename) so a crash never leaves it half written.
+With a KeyProvider the JSON is sealed with the active key and stored after
+manifestMagicEncrypted and the key header.
+*/
+
+const manifestName = "MANIFEST"
+
+var manifestMagicEncrypted = []byte("LENTAMFE")
+
+// fileMeta describes a registered SST file. Level 0 files come from MemTable flushes,
+// level 1 files from compactions.
+type fileMeta struct {
+	Name     string `json:"name"`
+	Level    int    `json:"level"`
+	Smallest []byte `json:"smallest"`
+	Largest  []byte `json:"largest"`
+	Size     int64  `json:"size"`
+	Entries  int    `json:"entries"`
+}
+
+func (m *fileMeta) contains(key []byte) bool {
+	return bytes.Compare(key, m.Smallest) >= 0 && bytes.Compare(key, m.Largest) <= 0
+}
+
+type familyManifest struct {
+	Name    string              `json:"name"`
+	Options ColumnFamilyOptions `json:"options"`
+	Files   []*fileMeta         `json:"files"` // nil for manifests written before files were registered
+	Blobs   []*blobMeta         `json:"blobs,omitempty"`
+}
+
+type Manifest struct {
+	Families     []familyManifest `json:"families"`
+	LastSequence uint64           `json:"lastSequence,omitempty"` // sequence number of the last write the SST files hold
+}
+
+func (m *Manifest) family(name string) *familyManifest {
+	for i := range m.Families {
+		if m.Families[i].Name == name {
+			return &m.Families[i]
+		}
+	}
+	return nil
+}
+
+// loadManifest reads the manifest of directory, keys opening an encrypted one.
+func loadManifest(fs VFS, directory string, keys KeyProvider) (*Manifest, error) {
+	m := &Manifest{}
+	content, err := readFile(fs, filepath.Join(directory, manifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if content, err = openContent(content, manifestMagicEncrypted, keys); err != nil {
+		return nil, fmt.Errorf("Manifest: %w", err)
+	}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, errors.New("Error parsing manifest")
+	}
+	return m, nil
+}
+
+// save replaces the manifest of directory, encrypted with the active key of keys when set.
+func (m *Manifest) save(fs VFS, directory string, keys KeyProvider) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if content, err = sealContent(content, manifestMagicEncrypted, keys); err != nil {
+		return err
+	}
+	return writeFileAtomic(fs, filepath.Join(directory, manifestName), content)
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const mmapSupported = true
+
+// mmapFile maps size bytes of file read-only into memory.
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+/*
+Options holds the tunables of a FileDB. DefaultOptions returns a usable configuration and
+Validate rejects inconsistent values instead of silently running with zero values.
+LoadOptions builds the options of the server from, in increasing order of precedence,
+the defaults, a config file (-config, KEY=VALUE lines like .env), the environment and the
+command line flags.
+*/
+
+type SyncMode int
+
+const (
+	SyncNone   SyncMode = iota // leave durability to the operating system
+	SyncFlush                  // sync SST files when they are sealed
+	SyncAlways                 // additionally sync the WAL after every write
+)
+
+func (s SyncMode) String() string {
+	switch s {
+	case SyncNone:
+		return "none"
+	case SyncFlush:
+		return "flush"
+	case SyncAlways:
+		return "always"
+	}
+	return "unknown"
+}
+
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return SyncNone, nil
+	case "flush":
+		return SyncFlush, nil
+	case "always":
+		return SyncAlways, nil
+	}
+	return SyncNone, fmt.Errorf("Invalid sync mode %q", s)
+}
+
+// maxRecordSize is the largest key + value an SST record can hold, its length is stored on 2 bytes.
+const maxRecordSize = 1<<16 - 3
+
+type Options struct {
+	MemTableSize         int                   // MemTable entries before a flush
+	MaxEntrySize         int                   // maximum size of key + value
+	MaxFileSize          int64                 // target size of an SST file
+	BlockSize            int                   // target size of an SST data block
+	BlockRestartInterval int                   // records between two keys stored in full in a data block
+	BlockCacheSize       int64                 // bytes of decoded blocks kept in memory
+	SyncMode             SyncMode              // when files are synced to stable storage
+	CompactionTrigger    int                   // number of SST files that triggers a compaction, 0 disables it
+	MaxOpenFiles         int                   // SST files kept open by the table cache
+	UseMmap              bool                  // map SST files into memory instead of reading them
+	Compression          []Codec               // codec of the data blocks of each level, the last one applies to deeper levels
+	CorruptionPolicy     CorruptionPolicy      // what Open does with SST files that fail their check
+	OnCorruption         func(CorruptionEvent) // called for every corruption found once the lock is released, must not block, may be nil
+	WALArchiveDir        string                // directory keeping every WAL segment for point-in-time recovery, none when empty
+	CheckpointDir        string                // directory of the checkpoints the server writes, none when empty
+	BlobThreshold        int                   // values of at least this many bytes are stored in blob files, 0 disables them
+	BlobGCRatio          float64               // share of garbage that makes a compaction rewrite a blob file, 0 never rewrites
+	KeyProvider          KeyProvider           // encrypts the SST files, the WAL and the manifest, nil keeps them in plain text
+	FS                   VFS                   // filesystem holding the database, nil is the operating system
+}
+
+/*
+ReadOptions tune a single read, nil means DefaultReadOptions.
+DontFillCache keeps the blocks it reads out of the block cache, for large scans that would
+otherwise push out the blocks of frequent point lookups.
+VerifyChecksums checks the CRC32C of every SST block read from disk; blocks served from the
+block cache are not checked again.
+*/
+type ReadOptions struct {
+	DontFillCache   bool
+	VerifyChecksums bool
+}
+
+func DefaultReadOptions() *ReadOptions {
+	return &ReadOptions{VerifyChecksums: true}
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		MemTableSize:         500,
+		MaxEntrySize:         200,
+		MaxFileSize:          4 << 20,
+		BlockSize:            4 << 10,
+		BlockRestartInterval: defaultRestartInterval,
+		BlockCacheSize:       8 << 20,
+		SyncMode:             SyncFlush,
+		CompactionTrigger:    0,
+		MaxOpenFiles:         100,
+		UseMmap:              false,
+		Compression:          []Codec{CodecLZ},
+		BlobThreshold:        0,
+		BlobGCRatio:          0.5,
+	}
+}
+
+// vfs returns the filesystem of the database.
+func (o *Options) vfs() VFS {
+	if o.FS == nil {
+		return OSFS{}
+	}
+	return o.FS
+}
+
+func (o *Options) Validate() error {
+	if o.MemTableSize < 1 {
+		return errors.New("MemTableSize must be at least 1")
+	}
+	if o.MaxEntrySize < 1 || o.MaxEntrySize > maxRecordSize {
+		return fmt.Errorf("MaxEntrySize must be between 1 and %d", maxRecordSize)
+	}
+	if o.MaxFileSize < 1024 {
+		return errors.New("MaxFileSize must be at least 1024 bytes")
+	}
+	if o.BlockSize < 64 {
+		return errors.New("BlockSize must be at least 64 bytes")
+	}
+	if o.BlockRestartInterval < 1 {
+		return errors.New("BlockRestartInterval must be at least 1")
+	}
+	if o.BlockCacheSize < 0 {
+		return errors.New("BlockCacheSize cannot be negative")
+	}
+	if o.SyncMode < SyncNone || o.SyncMode > SyncAlways {
+		return errors.New("Invalid sync mode")
+	}
+	if o.CompactionTrigger < 0 {
+		return errors.New("CompactionTrigger cannot be negative")
+	}
+	if o.MaxOpenFiles < 1 {
+		return errors.New("MaxOpenFiles must be at least 1")
+	}
+	if o.CorruptionPolicy < CorruptionFail || o.CorruptionPolicy > CorruptionReadOnly {
+		return errors.New("Invalid corruption policy")
+	}
+	if o.BlobThreshold < 0 {
+		return errors.New("BlobThreshold cannot be negative")
+	}
+	if o.BlobGCRatio < 0 || o.BlobGCRatio > 1 {
+		return errors.New("BlobGCRatio must be between 0 and 1")
+	}
+	if o.BlobThreshold > 0 && o.MaxEntrySize < blobPointerSize+2 {
+		return fmt.Errorf("MaxEntrySize must be at least %d bytes to hold blob pointers", blobPointerSize+2)
+	}
+	if o.KeyProvider != nil {
+		if o.BlobThreshold > 0 {
+			return errors.New("Blob files are not encrypted, BlobThreshold must be 0 with a KeyProvider")
+		}
+		if _, err := activeEncryptor(o.KeyProvider); err != nil {
+			return fmt.Errorf("Invalid active encryption key: %w", err)
+		}
+	}
+	for _, c := range o.Compression {
+		if c > CodecLZ {
+			return fmt.Errorf("Invalid compression codec %d", c)
+		}
+	}
+	return nil
+}
+
+// set applies one configuration key, as found in the environment or a config file.
+func (o *Options) set(key, value string) error {
+	var err error
+	switch key {
+	case "CACHE_SIZE", "MEMTABLE_SIZE":
+		o.MemTableSize, err = strconv.Atoi(value)
+	case "MAX_ENTRY_SIZE":
+		o.MaxEntrySize, err = strconv.Atoi(value)
+	case "MAX_FILE_SIZE":
+		o.MaxFileSize, err = strconv.ParseInt(value, 10, 64)
+	case "BLOCK_SIZE":
+		o.BlockSize, err = strconv.Atoi(value)
+	case "BLOCK_RESTART_INTERVAL":
+		o.BlockRestartInterval, err = strconv.Atoi(value)
+	case "BLOCK_CACHE_SIZE":
+		o.BlockCacheSize, err = strconv.ParseInt(value, 10, 64)
+	case "SYNC_MODE":
+		o.SyncMode, err = ParseSyncMode(value)
+	case "COMPACTION_TRIGGER":
+		o.CompactionTrigger, err = strconv.Atoi(value)
+	case "MAX_OPEN_FILES":
+		o.MaxOpenFiles, err = strconv.Atoi(value)
+	case "USE_MMAP":
+		o.UseMmap, err = strconv.ParseBool(value)
+	case "COMPRESSION":
+		o.Compression, err = ParseCodecs(value)
+	case "CORRUPTION_POLICY":
+		o.CorruptionPolicy, err = ParseCorruptionPolicy(value)
+	case "WAL_ARCHIVE_DIR":
+		o.WALArchiveDir = value
+	case "CHECKPOINT_DIR":
+		o.CheckpointDir = value
+	case "BLOB_THRESHOLD":
+		o.BlobThreshold, err = strconv.Atoi(value)
+	case "BLOB_GC_RATIO":
+		o.BlobGCRatio, err = strconv.ParseFloat(value, 64)
+	case "ENCRYPTION_KEY_FILE":
+		o.KeyProvider, err = NewFileKeyProvider(value)
+	case "ENCRYPTION_KEYS":
+		o.KeyProvider, err = ParseKeys(value)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value for %s: %v", key, err)
+	}
+	return nil
+}
+
+var optionKeys = []string{"CACHE_SIZE", "MEMTABLE_SIZE", "MAX_ENTRY_SIZE", "MAX_FILE_SIZE", "BLOCK_SIZE", "BLOCK_RESTART_INTERVAL", "BLOCK_CACHE_SIZE", "SYNC_MODE", "COMPACTION_TRIGGER", "MAX_OPEN_FILES", "USE_MMAP", "COMPRESSION", "CORRUPTION_POLICY", "WAL_ARCHIVE_DIR", "CHECKPOINT_DIR", "BLOB_THRESHOLD", "BLOB_GC_RATIO", "ENCRYPTION_KEY_FILE", "ENCRYPTION_KEYS"}
+
+// LoadOptions parses the server configuration and returns the data directory and the validated options.
+func LoadOptions(args []string) (string, *Options, error) {
+	fs := flag.NewFlagSet("lentadb", flag.ContinueOnError)
+	config := fs.String("config", "", "config file with KEY=VALUE lines")
+	dir := fs.String("dir", "", "data directory")
+	memTableSize := fs.Int("memtable-size", 0, "MemTable entries before a flush")
+	maxEntrySize := fs.Int("max-entry-size", 0, "maximum size of key + value")
+	maxFileSize := fs.Int64("max-file-size", 0, "target size of an SST file")
+	blockSize := fs.Int("block-size", 0, "target size of an SST data block")
+	restartInterval := fs.Int("block-restart-interval", 0, "records between two keys stored in full in a data block")
+	blockCacheSize := fs.Int64("block-cache-size", -1, "bytes of decoded blocks kept in memory")
+	syncMode := fs.String("sync", "", "sync mode: none, flush or always")
+	compactionTrigger := fs.Int("compaction-trigger", -1, "number of SST files that triggers a compaction, 0 disables it")
+	maxOpenFiles := fs.Int("max-open-files", 0, "SST files kept open by the table cache")
+	useMmap := fs.Bool("mmap", false, "map SST files into memory instead of reading them")
+	corruptionPolicy := fs.String("corruption-policy", "", "what to do with corrupted SST files: fail, quarantine or read-only")
+	compression := fs.String("compression", "", "comma separated block codecs per level: none, flate or lz")
+	blobThreshold := fs.Int("blob-threshold", -1, "values of at least this many bytes are stored in blob files, 0 disables them")
+	blobGCRatio := fs.Float64("blob-gc-ratio", -1, "share of garbage that makes a compaction rewrite a blob file")
+	walArchiveDir := fs.String("wal-archive-dir", "", "directory keeping every WAL segment for point-in-time recovery")
+	checkpointDir := fs.String("checkpoint-dir", "", "directory of the checkpoints written by POST /admin/checkpoint")
+	keyFile := fs.String("encryption-key-file", "", "file of id:hexkey lines encrypting the data at rest, the last one active")
+	if err := fs.Parse(args); err != nil {
+		return "", nil, err
+	}
+
+	opts := DefaultOptions()
+	directory := "data"
+	if *config != "" {
+		values, err := godotenv.Read(*config)
+		if err != nil {
+			return "", nil, fmt.Errorf("Error reading config file: %v", err)
+		}
+		for _, key := range optionKeys {
+			if value, ok := values[key]; ok {
+				if err := opts.set(key, value); err != nil {
+					return "", nil, err
+				}
+			}
+		}
+		if value, ok := values["DATA_DIR"]; ok {
+			directory = value
+		}
+	}
+	for _, key := range optionKeys {
+		if value, ok := os.LookupEnv(key); ok {
+			if err := opts.set(key, value); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if value, ok := os.LookupEnv("DATA_DIR"); ok {
+		directory = value
+	}
+
+	if *dir != "" {
+		directory = *dir
+	}
+	if *memTableSize != 0 {
+		opts.MemTableSize = *memTableSize
+	}
+	if *maxEntrySize != 0 {
+		opts.MaxEntrySize = *maxEntrySize
+	}
+	if *maxFileSize != 0 {
+		opts.MaxFileSize = *maxFileSize
+	}
+	if *blockSize != 0 {
+		opts.BlockSize = *blockSize
+	}
+	if *restartInterval != 0 {
+		opts.BlockRestartInterval = *restartInterval
+	}
+	if *blockCacheSize >= 0 {
+		opts.BlockCacheSize = *blockCacheSize
+	}
+	if *syncMode != "" {
+		mode, err := ParseSyncMode(*syncMode)
+		if err != nil {
+			return "", nil, err
+		}
+		opts.SyncMode = mode
+	}
+	if *compactionTrigger >= 0 {
+		opts.CompactionTrigger = *compactionTrigger
+	}
+	if *maxOpenFiles != 0 {
+		opts.MaxOpenFiles = *maxOpenFiles
+	}
+	if *compression != "" {
+		codecs, err := ParseCodecs(*compression)
+		if err != nil {
+			return "", nil, err
+		}
+		opts.Compression = codecs
+	}
+	if *corruptionPolicy != "" {
+		policy, err := ParseCorruptionPolicy(*corruptionPolicy)
+		if err != nil {
+			return "", nil, err
+		}
+		opts.CorruptionPolicy = policy
+	}
+	if *blobThreshold >= 0 {
+		opts.BlobThreshold = *blobThreshold
+	}
+	if *blobGCRatio >= 0 {
+		opts.BlobGCRatio = *blobGCRatio
+	}
+	if *walArchiveDir != "" {
+		opts.WALArchiveDir = *walArchiveDir
+	}
+	if *checkpointDir != "" {
+		opts.CheckpointDir = *checkpointDir
+	}
+	if *keyFile != "" {
+		if err := opts.set("ENCRYPTION_KEY_FILE", *keyFile); err != nil {
+			return "", nil, err
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "mmap" {
+			opts.UseMmap = *useMmap
+		}
+	})
+	if err := opts.Validate(); err != nil {
+		return "", nil, err
+	}
+	return directory, opts, nil
+}
+
+// commandOptions are the options of the lentadb commands: the defaults, with the encryption
+// keys of the environment so they can open an encrypted database.
+func commandOptions() (*Options, error) {
+	opts := DefaultOptions()
+	for _, key := range []string{"ENCRYPTION_KEY_FILE", "ENCRYPTION_KEYS"} {
+		if value, ok := os.LookupEnv(key); ok {
+			if err := opts.set(key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Point-in-time recovery rebuilds a database as it was after a given write, from a base copy
+(a checkpoint or a restored backup) and the WAL segments archived since it was taken
+(Options.WALArchiveDir). The manifest of the base records the sequence number of the last
+write its SST files hold; RecoverToPoint copies the base, then replays the archived records
+that follow it, in sequence order, until the target. A gap in the sequence numbers means a
+segment is missing, the recovery then fails rather than silently skipping writes.
+*/
+
+// RecoveryTarget is the last write a recovery replays. With both fields set the recovery
+// stops at whichever comes first.
+type RecoveryTarget struct {
+	Sequence uint64    // sequence number of the last write to replay, 0 for no limit
+	Time     time.Time // writes made after it are not replayed, zero for no limit
+}
+
+// ParseRecoveryTarget parses a sequence number or an RFC 3339 time.
+func ParseRecoveryTarget(s string) (RecoveryTarget, error) {
+	if seq, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return RecoveryTarget{Sequence: seq}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return RecoveryTarget{}, fmt.Errorf("Invalid recovery target %q, expected a sequence number or an RFC 3339 time", s)
+	}
+	return RecoveryTarget{Time: t}, nil
+}
+
+func (t RecoveryTarget) includes(r walRecord) bool {
+	if t.Sequence != 0 && r.Sequence > t.Sequence {
+		return false
+	}
+	return t.Time.IsZero() || !r.Time.After(t.Time)
+}
+
+type RecoveryReport struct {
+	BaseSequence uint64    `json:"baseSequence"` // last write held by the base
+	Segments     int       `json:"segments"`     // archived WAL segments read
+	Replayed     int       `json:"replayed"`     // writes replayed on top of the base
+	LastSequence uint64    `json:"lastSequence"` // last write of the recovered database
+	LastTime     time.Time `json:"lastTime"`     // time of that write, zero when the base holds it
+}
+
+// RecoverToPoint writes into dir, which must not exist yet, the database base turns into once
+// the writes archived in archive are replayed up to target. A nil opts uses DefaultOptions.
+func RecoverToPoint(base, archive, dir string, target RecoveryTarget, opts *Options) (*RecoveryReport, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	fs := opts.vfs()
+	if _, err := fs.Stat(filepath.Join(base, manifestName)); err != nil {
+		return nil, fmt.Errorf("%s is not a database: %v", base, err)
+	}
+	if _, err := fs.Stat(dir); err == nil {
+		return nil, fmt.Errorf("Recovery directory already exists: %s", dir)
+	}
+	manifest, err := loadManifest(fs, base, opts.KeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	report := &RecoveryReport{BaseSequence: manifest.LastSequence, LastSequence: manifest.LastSequence}
+	if target.Sequence != 0 && target.Sequence < manifest.LastSequence {
+		return nil, fmt.Errorf("The base already holds writes up to %d, past the target %d", manifest.LastSequence, target.Sequence)
+	}
+
+	// the WAL of the base holds the writes it had not flushed yet
+	sources := []string{(&FileManager{directory: base}).logPath()}
+	if archive != "" {
+		entries, err := fs.ReadDir(archive)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && filepath.Ext(entry.Name()) == ".wal" {
+				sources = append(sources, filepath.Join(archive, entry.Name()))
+				report.Segments++
+			}
+		}
+	}
+	records := make(map[uint64]walRecord)
+	for _, path := range sources {
+		wal, err := openWALReadOnly(fs, path, opts.KeyProvider)
+		if err != nil {
+			return nil, err
+		}
+		if wal == nil {
+			continue
+		}
+		err = wal.Replay(func(r walRecord) error {
+			if r.Sequence == 0 {
+				return nil
+			}
+			if r.Sequence <= manifest.LastSequence {
+				if !target.includes(r) {
+					return fmt.Errorf("The base holds write %d made at %s, past the target", r.Sequence, r.Time.Format(time.RFC3339Nano))
+				}
+				return nil
+			}
+			records[r.Sequence] = r
+			return nil
+		})
+		wal.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	sequences := make([]uint64, 0, len(records))
+	for seq := range records {
+		sequences = append(sequences, seq)
+	}
+	sort.Slice(sequences, func(i, j int) bool {
+		return sequences[i] < sequences[j]
+	})
+	var replay []walRecord
+	for _, seq := range sequences {
+		r := records[seq]
+		if !target.includes(r) {
+			break
+		}
+		if seq != report.LastSequence+1 {
+			return nil, fmt.Errorf("Missing WAL records %d to %d, is a segment of the archive missing?", report.LastSequence+1, seq-1)
+		}
+		replay = append(replay, r)
+		report.LastSequence = seq
+		report.LastTime = r.Time
+	}
+	if target.Sequence > report.LastSequence {
+		return nil, fmt.Errorf("The archive ends at write %d, before the target %d", report.LastSequence, target.Sequence)
+	}
+
+	// build the database next to its final place so an interrupted recovery is never mistaken for one
+	tmp := dir + ".tmp"
+	if err := fs.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := recoverInto(base, tmp, manifest, replay, opts); err != nil {
+		fs.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := fs.Rename(tmp, dir); err != nil {
+		fs.RemoveAll(tmp)
+		return nil, err
+	}
+	report.Replayed = len(replay)
+	return report, nil
+}
+
+func recoverInto(base, dir string, manifest *Manifest, replay []walRecord, opts *Options) error {
+	fs := opts.vfs()
+	for _, family := range manifest.Families {
+		target := familyDirectory(dir, family.Name)
+		if err := fs.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		for _, meta := range family.Files {
+			if err := linkOrCopy(fs, filepath.Join(familyDirectory(base, family.Name), meta.Name), filepath.Join(target, meta.Name)); err != nil {
+				return err
+			}
+		}
+		for _, meta := range family.Blobs {
+			if err := linkOrCopy(fs, filepath.Join(familyDirectory(base, family.Name), meta.name()), filepath.Join(target, meta.name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := manifest.save(fs, dir, opts.KeyProvider); err != nil {
+		return err
+	}
+	// the replayed writes are archived already
+	local := *opts
+	local.WALArchiveDir = ""
+	db, err := Open(dir, &local)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	for _, r := range replay {
+		if streamed(r.Batch) {
+			err = fmt.Errorf("Write %d stored a streamed value that is not in the WAL, recover from a base taken after it", r.Sequence)
+			break
+		}
+		if err = db.writeAt(r.Sequence, r.Time, r.Batch); err != nil {
+			break
+		}
+	}
+	db.mu.Unlock()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// restoreCommand implements lentadb restore [--until <sequence|time>] [--archive <dir>] <base> <target>.
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	until := fs.String("until", "", "last write to replay, a sequence number or an RFC 3339 time")
+	archive := fs.String("archive", "", "directory of the archived WAL segments")
+	if err := parseInterspersed(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Println("usage: lentadb restore [--until <sequence|time>] [--archive <dir>] <base> <target>")
+		return 2
+	}
+	var target RecoveryTarget
+	if *until != "" {
+		var err error
+		if target, err = ParseRecoveryTarget(*until); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	if *archive == "" {
+		*archive = os.Getenv("WAL_ARCHIVE_DIR")
+	}
+	opts, err := commandOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	report, err := RecoverToPoint(fs.Arg(0), *archive, fs.Arg(1), target, opts)
+	if err != nil {
+		fmt.Println("Restore failed:", err)
+		return 1
+	}
+	fmt.Printf("Replayed %d writes from %d archived segments on top of write %d\n", report.Replayed, report.Segments, report.BaseSequence)
+	if report.LastTime.IsZero() {
+		fmt.Printf("%s holds writes up to %d\n", fs.Arg(1), report.LastSequence)
+	} else {
+		fmt.Printf("%s holds writes up to %d, made at %s\n", fs.Arg(1), report.LastSequence, report.LastTime.Format(time.RFC3339Nano))
+	}
+	return 0
+}
+
+// streamed reports whether b holds a value written by SetStream, whose blob file the base lacks.
+func streamed(b *WriteBatch) bool {
+	for _, op := range b.ops {
+		if op.t == blobEntryType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+Repair rebuilds a database from whatever can still be read in its directory. It scans the
+SST files of every column family and the WAL, and keeps every record whose framing and
+checksum are valid; newer files win over older ones and the WAL over every file. When the
+manifest can be read, only the files it registers are scanned and the WAL records it says
+the SST files already hold are skipped: quarantined files in lost/, files left behind by a
+compaction and a WAL that was not emptied durably could otherwise bring back overwritten or
+deleted keys. RepairOptions.Unregistered scans every SST file, lost/ included, as does a
+repair without a readable manifest (lost/ aside). The salvaged records are written into
+fresh SST files registered in a new manifest, the WAL is emptied, scanned files that lost
+nothing are removed and the others are moved to lost/ for inspection.
+The returned report, also written as REPAIR-<time>.json in the directory, lists what was
+salvaged and what was lost. The directory is locked for the duration of the repair.
+*/
+
+type RepairReport struct {
+	Directory   string         `json:"directory"`
+	Time        time.Time      `json:"time"`
+	ManifestErr string         `json:"manifestError,omitempty"`
+	Families    []FamilyRepair `json:"families"`
+	WAL         WALRepair      `json:"wal"`
+}
+
+type FamilyRepair struct {
+	Name    string       `json:"name"`
+	Files   []FileRepair `json:"files"`
+	Keys    int          `json:"keys"`
+	Outputs []string     `json:"outputs"`
+}
+
+type FileRepair struct {
+	Name       string      `json:"name"`
+	Version    int64       `json:"version"`
+	Records    int         `json:"records"`
+	LostBlocks []LostRange `json:"lostBlocks,omitempty"`
+	Error      string      `json:"error,omitempty"` // set when the file could not be read at all
+}
+
+// LostRange is the key range of a block that could not be salvaged, After is exclusive.
+type LostRange struct {
+	Offset int64  `json:"offset"`
+	After  string `json:"after"`
+	Last   string `json:"last"`
+	Error  string `json:"error"`
+}
+
+type WALRepair struct {
+	Batches     int   `json:"batches"`
+	Skipped     int   `json:"skipped"` // batches read that the SST files already hold
+	LostRecords int   `json:"lostRecords"`
+	LostBytes   int64 `json:"lostBytes"`
+}
+
+// Lost reports whether any data could not be salvaged.
+func (r *RepairReport) Lost() bool {
+	if r.WAL.LostRecords > 0 || r.WAL.LostBytes > 0 {
+		return true
+	}
+	for _, family := range r.Families {
+		for _, file := range family.Files {
+			if file.Error != "" || len(file.LostBlocks) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// salvagedFamily accumulates the records of one column family, oldest first.
+type salvagedFamily struct {
+	name    string
+	f       *FileManager
+	entries map[string]Entry
+	newest  time.Time
+	sources []string // paths of the scanned files
+	damaged map[string]bool
+	report  FamilyRepair
+}
+
+type RepairOptions struct {
+	Unregistered bool // also salvage the SST files the manifest does not list and those in lost/
+}
+
+func Repair(dir string, opts *Options) (*RepairReport, error) {
+	return RepairWithOptions(dir, opts, RepairOptions{})
+}
+
+func RepairWithOptions(dir string, opts *Options, repair RepairOptions) (*RepairReport, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	fs := opts.vfs()
+	if _, err := fs.Stat(dir); err != nil {
+		return nil, err
+	}
+	lock, err := lockDirectory(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	report := &RepairReport{Directory: dir, Time: time.Now()}
+	manifest, err := loadManifest(fs, dir, opts.KeyProvider)
+	if errors.Is(err, ErrMissingKey) || errors.Is(err, ErrWrongKey) {
+		// without the keys every file would look damaged
+		return nil, err
+	}
+	if err != nil {
+		report.ManifestErr = err.Error()
+		manifest = &Manifest{}
+	}
+	// without a manifest nothing tells the registered files apart
+	scan := salvageScan{registered: report.ManifestErr == "" && !repair.Unregistered, lost: repair.Unregistered}
+	names := map[string]bool{DefaultColumnFamily: true}
+	for _, fm := range manifest.Families {
+		names[fm.Name] = true
+	}
+	// a family directory the manifest does not list belongs to a dropped family
+	if entries, err := fs.ReadDir(filepath.Join(dir, "cf")); err == nil && !scan.registered {
+		for _, e := range entries {
+			if e.IsDir() && validateFamilyName(e.Name()) == nil {
+				names[e.Name()] = true
+			}
+		}
+	}
+
+	families := make(map[string]*salvagedFamily)
+	for name := range names {
+		family, err := salvageFamily(dir, name, manifest.family(name), opts, scan)
+		if err != nil {
+			return nil, err
+		}
+		families[name] = family
+	}
+
+	// later writes keep numbering from the last salvaged one
+	rebuilt := &Manifest{LastSequence: manifest.LastSequence}
+	walPath := families[DefaultColumnFamily].f.logPath()
+	err = salvageWAL(fs, walPath, opts.KeyProvider, &report.WAL, func(r walRecord) {
+		if report.ManifestErr == "" && r.Sequence != 0 && r.Sequence <= manifest.LastSequence {
+			// the log was not emptied durably after a flush, newer values may be in the SST files
+			report.WAL.Skipped++
+			return
+		}
+		if r.Sequence > rebuilt.LastSequence {
+			rebuilt.LastSequence = r.Sequence
+		}
+		for _, op := range r.Batch.ops {
+			family, ok := families[op.family]
+			if !ok {
+				if validateFamilyName(op.family) != nil {
+					continue
+				}
+				created, err := salvageFamily(dir, op.family, nil, opts, scan)
+				if err != nil {
+					continue
+				}
+				family = created
+				families[op.family] = family
+			}
+			family.entries[string(op.key)] = Entry{Key: string(op.key), Value: string(op.value), t: op.t}
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// write the salvaged records before the new manifest makes them the only live files
+	for _, name := range sortedKeysOf(families) {
+		family := families[name]
+		outputs, err := family.write()
+		if err != nil {
+			return nil, err
+		}
+		options := ColumnFamilyOptions{CompactionTrigger: opts.CompactionTrigger}
+		if fm := manifest.family(name); fm != nil {
+			options = fm.Options
+		}
+		// blob files are kept whole, the salvaged pointers refer to them
+		blobs, err := family.f.adoptBlobs()
+		if err != nil {
+			return nil, err
+		}
+		rebuilt.Families = append(rebuilt.Families, familyManifest{Name: name, Options: options, Files: outputs, Blobs: blobs})
+		report.Families = append(report.Families, family.report)
+	}
+	if err := rebuilt.save(fs, dir, opts.KeyProvider); err != nil {
+		return nil, err
+	}
+	for _, name := range sortedKeysOf(families) {
+		families[name].cleanup()
+	}
+	if wal, err := openWAL(fs, walPath, opts.KeyProvider); err == nil {
+		err = wal.Reset()
+		wal.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("REPAIR-%d.json", report.Time.Unix())
+	if err := writeFileAtomic(fs, filepath.Join(dir, name), content); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// salvageScan selects the SST files a repair scans.
+type salvageScan struct {
+	registered bool // only the files the manifest lists
+	lost       bool // the quarantined files of lost/ too
+}
+
+func salvageFamily(root, name string, fm *familyManifest, opts *Options, scan salvageScan) (*salvagedFamily, error) {
+	f, err := newFileManager(opts.vfs(), familyDirectory(root, name))
+	if err != nil {
+		return nil, err
+	}
+	f.MaxFileSize = opts.MaxFileSize
+	f.SyncMode = opts.SyncMode
+	f.BlockSize = opts.BlockSize
+	f.RestartInterval = opts.BlockRestartInterval
+	f.Compression = opts.Compression
+	f.keys = opts.KeyProvider
+	if fm != nil {
+		f.TTL = fm.Options.TTL
+	}
+	family := &salvagedFamily{
+		name:    name,
+		f:       f,
+		entries: make(map[string]Entry),
+		damaged: make(map[string]bool),
+		report:  FamilyRepair{Name: name},
+	}
+	known := make(map[string]bool)
+	if fm != nil {
+		for _, meta := range fm.Files {
+			known[meta.Name] = true
+		}
+	}
+	dirs := []string{f.directory}
+	if scan.lost {
+		dirs = append(dirs, filepath.Join(f.directory, lostDirectory))
+	}
+	var paths []string
+	for _, dir := range dirs {
+		entries, err := f.fs.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || filepath.Ext(e.Name()) != ".sst" {
+				continue
+			}
+			// skipped files keep their number, the outputs must not take it
+			f.noteFileNumber(e.Name())
+			if scan.registered && !known[e.Name()] {
+				continue
+			}
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	// oldest first so newer records overwrite older ones
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+	for _, path := range paths {
+		file := family.salvageFile(path)
+		if file.Error != "" || len(file.LostBlocks) > 0 {
+			family.damaged[path] = true
+		}
+		family.sources = append(family.sources, path)
+		family.report.Files = append(family.report.Files, file)
+	}
+	return family, nil
+}
+
+// salvageFile adds every readable record of an SST file to the family.
+func (s *salvagedFamily) salvageFile(path string) FileRepair {
+	report := FileRepair{Name: filepath.Base(path)}
+	r, err := openSSTReader(s.f.fs, path, false, s.f.keys)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	defer r.Close()
+	report.Version = r.header.Version
+	if s.f.expired(r.modTime) {
+		// its data is gone with the TTL, it is not brought back
+		return report
+	}
+	if r.modTime.After(s.newest) {
+		s.newest = r.modTime
+	}
+	verify := &ReadOptions{DontFillCache: true, VerifyChecksums: true}
+	var after []byte
+	for i, e := range r.index {
+		block, err := r.rawBlock(i, verify)
+		var entries []Entry
+		if err == nil {
+			if r.header.Version >= 4 {
+				entries, err = decodePrefixBlock(block)
+			} else {
+				// records are framed one by one, keep those before the damage
+				err = scanRecords(block, func(e Entry) error {
+					entries = append(entries, e)
+					return nil
+				})
+			}
+		}
+		for _, entry := range entries {
+			s.entries[entry.Key] = entry
+		}
+		report.Records += len(entries)
+		if err != nil {
+			report.LostBlocks = append(report.LostBlocks, LostRange{Offset: e.offset, After: string(after), Last: string(e.lastKey), Error: err.Error()})
+		}
+		after = e.lastKey
+	}
+	return report
+}
+
+// salvageWAL calls fn for every WAL record whose framing and checksum are valid. Unlike
+// Replay it skips a corrupted record and goes on with the next one.
+func salvageWAL(fs VFS, path string, keys KeyProvider, report *WALRepair, fn func(walRecord)) error {
+	content, err := readFile(fs, path)
+	if err != nil {
+		return err
+	}
+	offset, legacy, enc, ok, err := logStart(content, keys)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return replayLegacyLog(content, func(b *WriteBatch) error {
+			report.Batches++
+			fn(walRecord{Batch: b})
+			return nil
+		})
+	}
+	for offset+8 <= len(content) {
+		size := int(binary.BigEndian.Uint32(content[offset:]))
+		if offset+8+size > len(content) {
+			break
+		}
+		payload := content[offset+8 : offset+8+size]
+		record, err := openWALRecord(payload, legacy, enc)
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(content[offset+4:]) || err != nil {
+			report.LostRecords++
+		} else {
+			report.Batches++
+			fn(record)
+		}
+		offset += 8 + size
+	}
+	report.LostBytes = int64(len(content) - offset)
+	return nil
+}
+
+// write stores the salvaged records in new level 1 files, tombstones are dropped since no
+// older data survives the repair.
+func (s *salvagedFamily) write() ([]*fileMeta, error) {
+	w := s.f.newSSTWriter(1)
+	keys := sortedKeys(s.entries)
+	for _, key := range keys {
+		e := s.entries[key]
+		if e.t == 1 {
+			continue
+		}
+		if err := w.Add(e); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		s.report.Keys++
+	}
+	outputs, err := w.Finish()
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	for _, meta := range outputs {
+		if !s.newest.IsZero() {
+			s.f.fs.Chtimes(s.f.path(meta), s.newest, s.newest)
+		}
+		s.report.Outputs = append(s.report.Outputs, meta.Name)
+	}
+	if outputs == nil {
+		outputs = []*fileMeta{}
+	}
+	return outputs, nil
+}
+
+// cleanup removes the scanned files that were fully salvaged and moves the others to lost/.
+func (s *salvagedFamily) cleanup() {
+	lost := filepath.Join(s.f.directory, lostDirectory)
+	for _, path := range s.sources {
+		if !s.damaged[path] {
+			s.f.fs.Remove(path)
+			continue
+		}
+		if filepath.Dir(path) == lost {
+			continue
+		}
+		if err := s.f.fs.MkdirAll(lost, 0755); err == nil {
+			s.f.fs.Rename(path, filepath.Join(lost, filepath.Base(path)))
+		}
+	}
+}
+
+func sortedKeysOf(families map[string]*salvagedFamily) []string {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// repairCommand implements lentadb repair <dir>.
+func repairCommand(args []string) int {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	unregistered := fs.Bool("unregistered", false, "also salvage the SST files the manifest does not list and the quarantined ones in lost/")
+	if err := parseInterspersed(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: lentadb repair [--unregistered] <dir>")
+		return 2
+	}
+	opts, err := commandOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	report, err := RepairWithOptions(fs.Arg(0), opts, RepairOptions{Unregistered: *unregistered})
+	if err != nil {
+		fmt.Println("Repair failed:", err)
+		return 1
+	}
+	for _, family := range report.Families {
+		fmt.Printf("%s: %d keys in %d files\n", family.Name, family.Keys, len(family.Outputs))
+		for _, file := range family.Files {
+			if file.Error != "" {
+				fmt.Printf("  %s: unreadable, %s\n", file.Name, file.Error)
+			}
+			for _, block := range file.LostBlocks {
+				fmt.Printf("  %s: lost keys in (%q, %q], %s\n", file.Name, block.After, block.Last, block.Error)
+			}
+		}
+	}
+	fmt.Printf("wal: %d batches read, %d of them already in the SST files, %d records and %d bytes lost\n", report.WAL.Batches, report.WAL.Skipped, report.WAL.LostRecords, report.WAL.LostBytes)
+	if report.Lost() {
+		fmt.Println("Some data could not be salvaged, see the report in", report.Directory)
+	} else {
+		fmt.Println("Nothing was lost")
+	}
+	return 0
+}
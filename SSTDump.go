@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+/*
+dumpSST prints the header of an SST file, then every data block with its offset, size and
+checksum status followed by its records, and finally the result of the whole file check.
+With stats only the totals are printed: record counts, key and value sizes, and block sizes
+with the compression ratio. Keys and values are printed quoted, or in hex with hexValues or
+when they are not valid UTF-8.
+*/
+
+type sstStats struct {
+	blocks, puts, tombstones int
+	blobs                    int
+	corruptBlocks            int
+	rawBytes, storedBytes    int64
+	keys, values             sizeStats
+}
+
+// sizeStats tracks a size distribution in power of two buckets.
+type sizeStats struct {
+	count, total, min, max int
+	buckets                [33]int
+}
+
+func (s *sizeStats) add(n int) {
+	if s.count == 0 || n < s.min {
+		s.min = n
+	}
+	if n > s.max {
+		s.max = n
+	}
+	s.count++
+	s.total += n
+	s.buckets[bits.Len32(uint32(n))]++
+}
+
+func (s *sizeStats) print(w io.Writer, name string) {
+	if s.count == 0 {
+		fmt.Fprintf(w, "%s: none\n", name)
+		return
+	}
+	fmt.Fprintf(w, "%s: min %d, avg %.1f, max %d bytes\n", name, s.min, float64(s.total)/float64(s.count), s.max)
+	for i, n := range s.buckets {
+		if n == 0 {
+			continue
+		}
+		low, high := 0, 0
+		if i > 0 {
+			low, high = 1<<(i-1), 1<<i-1
+		}
+		fmt.Fprintf(w, "  %6d - %-6d %d\n", low, high, n)
+	}
+}
+
+func dumpSST(w io.Writer, path string, keys KeyProvider, hexValues, stats bool) error {
+	r, err := openSSTReader(OSFS{}, path, false, keys)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fmt.Fprintf(w, "file:      %s\n", path)
+	fmt.Fprintf(w, "magic:     %q\n", r.header.magic)
+	fmt.Fprintf(w, "version:   %d\n", r.header.Version)
+	fmt.Fprintf(w, "codec:     %s\n", r.header.Codec)
+	fmt.Fprintf(w, "timestamp: %s\n", r.header.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+	if r.header.KeyID != 0 {
+		fmt.Fprintf(w, "key:       %d\n", r.header.KeyID)
+	}
+	fmt.Fprintf(w, "size:      %d bytes, %d blocks, %d bytes of filter\n", r.size, len(r.index), len(r.filter))
+
+	format := func(b string) string {
+		if hexValues || !utf8.ValidString(b) {
+			return hex.EncodeToString([]byte(b))
+		}
+		return strconv.Quote(b)
+	}
+	var s sstStats
+	for i, e := range r.index {
+		s.blocks++
+		s.storedBytes += e.size
+		status := "ok"
+		block, err := r.rawBlock(i, DefaultReadOptions())
+		if err != nil {
+			status = err.Error()
+			s.corruptBlocks++
+			// show what the damaged block still holds
+			block, err = r.rawBlock(i, &ReadOptions{})
+		}
+		var entries []Entry
+		if err == nil {
+			s.rawBytes += int64(len(block))
+			entries, err = r.decodeRecords(block)
+		}
+		if !stats {
+			fmt.Fprintf(w, "block %d: offset %d, size %d, checksum %s\n", i, e.offset, e.size, status)
+		}
+		for _, entry := range entries {
+			s.keys.add(len(entry.Key))
+			if entry.t == 1 {
+				s.tombstones++
+			} else if entry.t == blobEntryType {
+				s.blobs++
+			} else {
+				s.puts++
+				s.values.add(len(entry.Value))
+			}
+			if stats {
+				continue
+			}
+			if entry.t == 1 {
+				fmt.Fprintf(w, "  del %s\n", format(entry.Key))
+			} else if entry.t == blobEntryType {
+				if p, err := decodeBlobPointer(entry.Value); err == nil {
+					fmt.Fprintf(w, "  blob %s -> %d.blob offset %d, length %d\n", format(entry.Key), p.file, p.offset, p.length)
+				} else {
+					fmt.Fprintf(w, "  blob %s -> %v\n", format(entry.Key), err)
+				}
+			} else {
+				fmt.Fprintf(w, "  put %s = %s\n", format(entry.Key), format(entry.Value))
+			}
+		}
+		if err != nil && !stats {
+			fmt.Fprintf(w, "  undecodable: %v\n", err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	status := "ok"
+	if err := (&FileManager{}).ValidateFile(file); err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(w, "file checksum: %s\n", status)
+	if !stats {
+		return nil
+	}
+	if s.blobs > 0 {
+		fmt.Fprintf(w, "records:   %d (%d puts, %d blob pointers, %d tombstones)\n", s.puts+s.blobs+s.tombstones, s.puts, s.blobs, s.tombstones)
+	} else {
+		fmt.Fprintf(w, "records:   %d (%d puts, %d tombstones)\n", s.puts+s.tombstones, s.puts, s.tombstones)
+	}
+	fmt.Fprintf(w, "blocks:    %d (%d corrupted)\n", s.blocks, s.corruptBlocks)
+	ratio := 0.0
+	if s.storedBytes > 0 {
+		ratio = float64(s.rawBytes) / float64(s.storedBytes)
+	}
+	fmt.Fprintf(w, "data:      %d bytes stored, %d bytes decoded, ratio %.2f\n", s.storedBytes, s.rawBytes, ratio)
+	s.keys.print(w, "keys")
+	s.values.print(w, "values")
+	return nil
+}
+
+// sstDumpCommand implements lentadb sst-dump [--hex] [--stats] <file>.
+func sstDumpCommand(args []string) int {
+	fs := flag.NewFlagSet("sst-dump", flag.ContinueOnError)
+	hexValues := fs.Bool("hex", false, "print keys and values in hex")
+	stats := fs.Bool("stats", false, "print statistics instead of the records")
+	if err := parseInterspersed(fs, args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Println("usage: lentadb sst-dump [--hex] [--stats] <file>")
+		return 2
+	}
+	opts, err := commandOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err := dumpSST(os.Stdout, fs.Arg(0), opts.KeyProvider, *hexValues, *stats); err != nil {
+		fmt.Println("Error reading SST file:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses args allowing flags after the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return fs.Parse(append([]string{"--"}, positional...))
+}
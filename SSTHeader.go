@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"time"
@@ -16,7 +17,10 @@ type SSTHeader struct {
 	size 	int64  //header size
 	magic 	[]byte //8 bytes
 	Version   int64 //2 bytes
+	Codec     Codec //1 byte, compression of the data blocks
 	Timestamp time.Time 
+	KeyID     uint32 //4 bytes, key the blocks are encrypted with, 0 when they are not
+	KeyCheck  []byte //8 bytes, tells the key apart from another key with the same ID
 }
 func TimeStampToBytes(t time.Time) []byte {
 	s := t.UTC().Format(time.RFC3339)
@@ -27,9 +31,11 @@ func TimeStampToBytes(t time.Time) []byte {
 func (s *SSTHeader) WriteHeader(w io.Writer) error {
 	header := make([]byte, s.size)
 	copy(header[0:], s.magic)
-	copy(header[8:], []byte{0, 0, 0, 0, 0, 0, 0, 0})
-	copy(header[16:], []byte{0, 0})
+	copy(header[8:], []byte{byte(s.Version), 0, 0, 0, 0, 0, 0, 0})
+	copy(header[16:], []byte{byte(s.Codec), 0})
 	copy(header[18:], TimeStampToBytes(s.Timestamp))
+	binary.BigEndian.PutUint32(header[38:], s.KeyID)
+	copy(header[42:50], s.KeyCheck)
 	_, err := w.Write(header)
 	if err != nil {
 		fmt.Println("Error writing header")
@@ -50,6 +56,9 @@ func (s *SSTHeader) ReadHeader(r io.ReaderAt) error {
 	}
 	s.magic = header[0:8]
 	s.Version = int64(header[8])
+	s.Codec = Codec(header[16])
+	s.KeyID = binary.BigEndian.Uint32(header[38:])
+	s.KeyCheck = header[42:50]
 	s.Timestamp, err = time.Parse(time.RFC3339, string(header[18:38]))
 	if err != nil {
 		fmt.Println("Error parsing timestamp")
@@ -58,6 +67,8 @@ func (s *SSTHeader) ReadHeader(r io.ReaderAt) error {
 	return nil
 }
 
+var sstMagic = []byte("LENTASST")
+
 func NewSSTHeader() *SSTHeader {
 	return &SSTHeader{size: 50}
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+An sstReader keeps an SST file open together with what is needed to serve point lookups:
+the parsed header, the index of its data blocks and its bloom filter.
+
+Version 5 files (written by sstWriter) are laid out as
+header | data blocks | index block | filter block | footer
+where every block ends with the CRC32C of its content, data blocks hold sorted, prefix
+compressed records (see blockBuilder) followed by the byte of the Codec they are stored with,
+the index block lists for every data block its last key, offset and size, and the footer
+holds the offset and size of the index and filter blocks, then the CRC32C of the file content
+before it and of the footer itself. Blocks of encrypted files are sealed with the key their
+header names.
+Older files have no block checksums and end with the md5 of the whole file instead:
+header | data blocks | index block | filter block | footer | md5
+Version 4 files are otherwise laid out like version 5 ones, version 3 files store their
+records in full, as Entry.toBytes does, and version 2 files additionally have no codec byte.
+Version 1 files (header | records | md5) are served as a single block without filter.
+Decoded data blocks go through the shared BlockCache when the reader has one.
+
+With mmap the whole file is mapped into memory and blocks are served as slices of the
+mapping instead of being copied out with ReadAt. Readers are reference counted: the table
+cache holds one reference and every get hands out another one, released by the caller once
+it is done, so a file evicted or deleted by a compaction stays mapped until its last user
+is finished with it.
+*/
+
+const sstVersion = 5
+
+const (
+	footerSize       = 40
+	legacyFooterSize = 32
+	blockTrailerSize = crc32.Size
+)
+
+// ErrCorruption is wrapped by the errors reporting a checksum mismatch in an SST file.
+var ErrCorruption = errors.New("Corrupted SST file")
+
+type indexEntry struct {
+	lastKey []byte
+	offset  int64
+	size    int64
+}
+
+type sstReader struct {
+	file    File
+	header  *SSTHeader
+	size    int64
+	modTime time.Time
+	index   []indexEntry
+	filter  bloomFilter
+	blocks  *BlockCache
+	id      uint64
+	data    []byte     // the mapped file, nil when reading with ReadAt
+	enc     *encryptor // opens the blocks of an encrypted file
+	refs    int32
+}
+
+// openSSTReader opens the file at path, the returned reader holds one reference.
+// Encrypted files need their key from keys.
+func openSSTReader(fs VFS, path string, mmap bool, keys KeyProvider) (*sstReader, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &sstReader{file: file, header: NewSSTHeader(), refs: 1}
+	if err := r.load(mmap, keys); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *sstReader) load(mmap bool, keys KeyProvider) error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.size = info.Size()
+	r.modTime = info.ModTime()
+	if file, ok := r.file.(*os.File); ok && mmap && mmapSupported && r.size > 0 {
+		if r.data, err = mmapFile(file, r.size); err != nil {
+			return err
+		}
+	}
+	if err := r.header.ReadHeader(r.file); err != nil {
+		return err
+	}
+	if r.header.Version >= 5 {
+		if r.enc, err = keyEncryptor(keys, r.header.KeyID, r.header.KeyCheck); err != nil {
+			return fmt.Errorf("%s: %w", r.file.Name(), err)
+		}
+		return r.loadFooter()
+	}
+	dataEnd := r.size - md5.Size
+	if r.header.Version < 2 {
+		if dataEnd < r.header.Size() {
+			return errors.New("File is too small")
+		}
+		r.index = []indexEntry{{offset: r.header.Size(), size: dataEnd - r.header.Size()}}
+		return nil
+	}
+	if dataEnd-legacyFooterSize < r.header.Size() {
+		return errors.New("File is too small")
+	}
+	footer, err := r.readAt(dataEnd-legacyFooterSize, legacyFooterSize)
+	if err != nil {
+		return err
+	}
+	return r.loadBlocks(footer, dataEnd)
+}
+
+func (r *sstReader) loadFooter() error {
+	if r.size-footerSize < r.header.Size() {
+		return errors.New("File is too small")
+	}
+	footer, err := r.readAt(r.size-footerSize, footerSize)
+	if err != nil {
+		return err
+	}
+	if crc32.Checksum(footer[:footerSize-4], castagnoli) != binary.BigEndian.Uint32(footer[footerSize-4:]) {
+		return r.corruption(r.size-footerSize, "footer checksum mismatch")
+	}
+	return r.loadBlocks(footer, r.size-footerSize)
+}
+
+// loadBlocks reads the index and filter blocks located by footer.
+func (r *sstReader) loadBlocks(footer []byte, dataEnd int64) error {
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:]))
+	indexSize := int64(binary.BigEndian.Uint64(footer[8:]))
+	filterOffset := int64(binary.BigEndian.Uint64(footer[16:]))
+	filterSize := int64(binary.BigEndian.Uint64(footer[24:]))
+	if indexOffset < r.header.Size() || indexSize < 0 || filterSize < 0 || indexOffset+indexSize > dataEnd || filterOffset+filterSize > dataEnd {
+		return errors.New("Invalid SST footer")
+	}
+	indexBlock, err := r.readChecked(indexOffset, indexSize, true)
+	if err != nil {
+		return err
+	}
+	r.index, err = decodeIndex(indexBlock)
+	if err != nil {
+		return err
+	}
+	r.filter, err = r.readChecked(filterOffset, filterSize, true)
+	return err
+}
+
+// readChecked reads a block and, for version 5 files, strips its checksum after checking it
+// when verify is set and decrypts it when the file is encrypted.
+func (r *sstReader) readChecked(offset, size int64, verify bool) ([]byte, error) {
+	block, err := r.readAt(offset, size)
+	if err != nil || r.header.Version < 5 {
+		return block, err
+	}
+	if len(block) < blockTrailerSize {
+		return nil, r.corruption(offset, "block too small")
+	}
+	content := block[:len(block)-blockTrailerSize]
+	if verify && crc32.Checksum(content, castagnoli) != binary.BigEndian.Uint32(block[len(content):]) {
+		return nil, r.corruption(offset, "block checksum mismatch")
+	}
+	if r.enc != nil {
+		// the authentication tag is checked whatever verify says
+		if content, err = r.enc.open(content, offsetData(offset)); err != nil {
+			return nil, r.corruption(offset, "block decryption failed")
+		}
+	}
+	return content, nil
+}
+
+func (r *sstReader) corruption(offset int64, reason string) error {
+	return fmt.Errorf("%w: %s at offset %d of %s", ErrCorruption, reason, offset, r.file.Name())
+}
+
+// readAt returns size bytes at offset, a slice of the mapping when the file is mapped.
+func (r *sstReader) readAt(offset, size int64) ([]byte, error) {
+	if offset < 0 || size < 0 || offset+size > r.size {
+		return nil, errors.New("Read beyond the end of the SST file")
+	}
+	if r.data != nil {
+		return r.data[offset : offset+size : offset+size], nil
+	}
+	buf := make([]byte, size)
+	_, err := r.file.ReadAt(buf, offset)
+	return buf, err
+}
+
+func decodeIndex(block []byte) ([]indexEntry, error) {
+	var index []indexEntry
+	for len(block) > 0 {
+		key, rest, err := readBytes(block)
+		if err != nil {
+			return nil, errors.New("Invalid SST index block")
+		}
+		offset, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, errors.New("Invalid SST index block")
+		}
+		size, m := binary.Uvarint(rest[n:])
+		if m <= 0 {
+			return nil, errors.New("Invalid SST index block")
+		}
+		index = append(index, indexEntry{lastKey: key, offset: int64(offset), size: int64(size)})
+		block = rest[n+m:]
+	}
+	return index, nil
+}
+
+func encodeIndexEntry(buf []byte, e indexEntry) []byte {
+	buf = appendBytes(buf, e.lastKey)
+	buf = binary.AppendUvarint(buf, uint64(e.offset))
+	return binary.AppendUvarint(buf, uint64(e.size))
+}
+
+// cachedBlock returns the decoded records of block i if they are in the block cache.
+func (r *sstReader) cachedBlock(i int) ([]Entry, bool) {
+	if r.blocks == nil {
+		return nil, false
+	}
+	return r.blocks.get(blockKey{file: r.id, offset: r.index[i].offset})
+}
+
+func (r *sstReader) fillCache(ro *ReadOptions) bool {
+	return r.blocks != nil && (ro == nil || !ro.DontFillCache)
+}
+
+// rawBlock reads block i, checks its checksum and undoes its compression.
+func (r *sstReader) rawBlock(i int, ro *ReadOptions) ([]byte, error) {
+	e := r.index[i]
+	block, err := r.readChecked(e.offset, e.size, ro == nil || ro.VerifyChecksums)
+	if err != nil {
+		return nil, err
+	}
+	if r.header.Version >= 3 {
+		return decodeBlock(block)
+	}
+	return block, nil
+}
+
+func (r *sstReader) decodeRecords(block []byte) ([]Entry, error) {
+	if r.header.Version >= 4 {
+		return decodePrefixBlock(block)
+	}
+	var entries []Entry
+	err := scanRecords(block, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// readBlock returns the decoded records of block i, from the block cache when possible.
+func (r *sstReader) readBlock(i int, ro *ReadOptions) ([]Entry, error) {
+	if entries, ok := r.cachedBlock(i); ok {
+		return entries, nil
+	}
+	return r.loadBlock(i, ro)
+}
+
+func (r *sstReader) loadBlock(i int, ro *ReadOptions) ([]Entry, error) {
+	block, err := r.rawBlock(i, ro)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := r.decodeRecords(block)
+	if err != nil {
+		return nil, err
+	}
+	if r.fillCache(ro) {
+		r.blocks.insert(blockKey{file: r.id, offset: r.index[i].offset}, entries, int64(len(block)))
+	}
+	return entries, nil
+}
+
+// Get looks key up, the returned Entry may be a tombstone.
+func (r *sstReader) Get(key []byte, ro *ReadOptions) (Entry, bool, error) {
+	if r.filter != nil && !r.filter.mayContain(key) {
+		return Entry{}, false, nil
+	}
+	i := 0
+	if r.header.Version >= 2 {
+		i = sort.Search(len(r.index), func(i int) bool {
+			return bytes.Compare(r.index[i].lastKey, key) >= 0
+		})
+		if i == len(r.index) {
+			return Entry{}, false, nil
+		}
+	}
+	entries, ok := r.cachedBlock(i)
+	if !ok {
+		if r.header.Version >= 4 && !r.fillCache(ro) {
+			// the block will not be cached, decode only what the lookup needs
+			block, err := r.rawBlock(i, ro)
+			if err != nil {
+				return Entry{}, false, err
+			}
+			return seekPrefixBlock(block, key)
+		}
+		var err error
+		if entries, err = r.loadBlock(i, ro); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	if r.header.Version >= 2 {
+		j := sort.Search(len(entries), func(j int) bool {
+			return entries[j].Key >= string(key)
+		})
+		if j < len(entries) && entries[j].Key == string(key) {
+			return entries[j], true, nil
+		}
+		return Entry{}, false, nil
+	}
+	var found Entry
+	ok = false
+	for _, e := range entries {
+		// version 1 files may hold a key several times, the last record wins
+		if e.Key == string(key) {
+			found, ok = e, true
+		}
+	}
+	return found, ok, nil
+}
+
+// seek returns the first block that may hold keys at or after start.
+func (r *sstReader) seek(start []byte) int {
+	if r.header.Version < 2 {
+		return 0
+	}
+	return sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].lastKey, start) >= 0
+	})
+}
+
+// scan calls fn for every record of the file in file order.
+func (r *sstReader) scan(fn func(Entry) error, ro *ReadOptions) error {
+	for i := range r.index {
+		entries, err := r.readBlock(i, ro)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scanRecords(block []byte, fn func(Entry) error) error {
+	offset := 0
+	for offset+2 <= len(block) {
+		entrySize := int(binary.BigEndian.Uint16(block[offset:]))
+		if entrySize == 0 || offset+2+entrySize > len(block) {
+			return errors.New("Invalid record in SST block")
+		}
+		if err := fn(decodeEntry(block[offset+2 : offset+2+entrySize])); err != nil {
+			return err
+		}
+		offset += entrySize + 2
+	}
+	return nil
+}
+
+func (r *sstReader) ref() {
+	atomic.AddInt32(&r.refs, 1)
+}
+
+// Close releases one reference, the file is unmapped and closed with the last one.
+func (r *sstReader) Close() error {
+	if atomic.AddInt32(&r.refs, -1) > 0 {
+		return nil
+	}
+	return r.close()
+}
+
+func (r *sstReader) close() error {
+	if r.data != nil {
+		munmap(r.data)
+		r.data = nil
+	}
+	return r.file.Close()
+}
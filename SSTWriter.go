@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+)
+
+/*
+The sstWriter writes sorted entries into SST files of a FileManager, in the block based
+layout described with sstReader. Records are grouped into data blocks of about BlockSize
+bytes, prefix compressed (see blockBuilder) and compressed with the codec of the level, and
+every block is followed by its CRC32C. The index, the bloom filter and the footer, which holds
+the CRC32C of the whole file, are written when the file is finished.
+Whenever adding an entry would grow the current file beyond MaxFileSize the file is finished
+and a new one is started, so every output file covers its own disjoint key range.
+Finish returns the metadata of the finished files; they are registered by the caller.
+*/
+
+const defaultBlockSize = 4 << 10
+
+type sstWriter struct {
+	f       *FileManager
+	level   int
+	name    string // name of the output file, nextFileName when empty
+	codec   Codec
+	file    File
+	out     *bufio.Writer
+	hasher  hash.Hash32
+	enc     *encryptor // seals the blocks of the current file, nil without encryption
+	meta    *fileMeta
+	outputs []*fileMeta
+
+	offset  int64 // bytes written to the current file
+	block   *blockBuilder
+	lastKey []byte
+	index   []byte
+	keys    [][]byte
+}
+
+func (f *FileManager) newSSTWriter(level int) *sstWriter {
+	return &sstWriter{f: f, level: level, codec: f.codec(level), block: newBlockBuilder(f.RestartInterval)}
+}
+
+func (w *sstWriter) blockSize() int {
+	if w.f.BlockSize > 0 {
+		return w.f.BlockSize
+	}
+	return defaultBlockSize
+}
+
+// projectedSize estimates the size of the current file once e is added.
+func (w *sstWriter) projectedSize(e Entry) int64 {
+	filterBits := (len(w.keys) + 1) * bloomBitsPerKey
+	if filterBits < 64 {
+		filterBits = 64
+	}
+	// the pending block is counted raw with e stored as a restart point, prefix and
+	// block compression only make it smaller
+	record := 1 + 3*binary.MaxVarintLen64 + len(e.Key) + len(e.Value) + 4
+	size := w.offset + int64(w.block.estimatedSize()+record+1+blockTrailerSize+len(w.index))
+	size += int64(len(e.Key) + 2*binary.MaxVarintLen64 + 2)
+	size += int64(filterBits/8 + 2)
+	size += 3*blockTrailerSize + footerSize
+	if w.enc != nil {
+		size += 3 * sealOverhead
+	}
+	return size
+}
+
+func (w *sstWriter) Add(e Entry) error {
+	key := []byte(e.Key)
+	if w.meta != nil && bytes.Compare(key, w.meta.Largest) <= 0 {
+		return errors.New("Keys must be added in increasing order")
+	}
+	if w.file != nil && w.f.MaxFileSize > 0 && w.projectedSize(e) > w.f.MaxFileSize {
+		if err := w.finishFile(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		if err := w.openFile(); err != nil {
+			return err
+		}
+	}
+	if !w.block.empty() && w.block.estimatedSize()+len(e.Key)+len(e.Value) > w.blockSize() {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	w.block.add(e)
+	w.lastKey = key
+	w.keys = append(w.keys, key)
+	if w.meta.Entries == 0 {
+		w.meta.Smallest = key
+	}
+	w.meta.Largest = key
+	w.meta.Entries++
+	return nil
+}
+
+func (w *sstWriter) openFile() error {
+	name := w.name
+	if name == "" {
+		name = w.f.nextFileName()
+	}
+	// files take the active key when they start, a rotation applies to the following ones
+	enc, err := activeEncryptor(w.f.keys)
+	if err != nil {
+		return err
+	}
+	file, err := w.f.fs.Create(filepath.Join(w.f.directory, name))
+	if err != nil {
+		fmt.Println("Error creating new file")
+		return err
+	}
+	w.enc = enc
+	w.file = file
+	w.hasher = crc32.New(castagnoli)
+	w.out = bufio.NewWriter(io.MultiWriter(file, w.hasher))
+	w.meta = &fileMeta{Name: name, Level: w.level}
+	w.block.reset()
+	w.index, w.keys = nil, nil
+	if err := w.f.writeHeader(w.out, w.codec, w.enc); err != nil {
+		return err
+	}
+	w.offset = w.f.fileheader.Size()
+	return nil
+}
+
+func (w *sstWriter) flushBlock() error {
+	stored := appendChecksum(w.seal(encodeBlock(w.codec, w.block.finish())))
+	if _, err := w.out.Write(stored); err != nil {
+		return err
+	}
+	w.index = encodeIndexEntry(w.index, indexEntry{lastKey: w.lastKey, offset: w.offset, size: int64(len(stored))})
+	w.offset += int64(len(stored))
+	w.block.reset()
+	return nil
+}
+
+// finishFile writes the last data block, the index, the filter and the footer, whose last
+// fields are the CRC32C of the whole file content and of the footer itself, then closes it.
+func (w *sstWriter) finishFile() error {
+	if !w.block.empty() {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	index := appendChecksum(w.seal(w.index))
+	filter := appendChecksum(w.sealAt(newBloomFilter(w.keys), w.offset+int64(len(index))))
+	footer := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(footer[0:], uint64(w.offset))
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(index)))
+	binary.BigEndian.PutUint64(footer[16:], uint64(w.offset)+uint64(len(index)))
+	binary.BigEndian.PutUint64(footer[24:], uint64(len(filter)))
+	for _, part := range [][]byte{index, filter} {
+		if _, err := w.out.Write(part); err != nil {
+			return err
+		}
+		w.offset += int64(len(part))
+	}
+	if err := w.out.Flush(); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(footer[32:], w.hasher.Sum32())
+	binary.BigEndian.PutUint32(footer[36:], crc32.Checksum(footer[:36], castagnoli))
+	if _, err := w.file.Write(footer); err != nil {
+		fmt.Println("Error writing footer")
+		return err
+	}
+	w.offset += footerSize
+	if w.f.SyncMode != SyncNone {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.meta.Size = w.offset
+	w.outputs = append(w.outputs, w.meta)
+	w.file = nil
+	return w.f.syncDirectory()
+}
+
+// seal encrypts a block written at the current offset, when the file is encrypted.
+func (w *sstWriter) seal(block []byte) []byte {
+	return w.sealAt(block, w.offset)
+}
+
+func (w *sstWriter) sealAt(block []byte, offset int64) []byte {
+	if w.enc == nil {
+		return block
+	}
+	return w.enc.seal(block, offsetData(offset))
+}
+
+// appendChecksum appends the CRC32C of block to it.
+func appendChecksum(block []byte) []byte {
+	return binary.BigEndian.AppendUint32(block, crc32.Checksum(block, castagnoli))
+}
+
+func (w *sstWriter) Finish() ([]*fileMeta, error) {
+	if w.file != nil {
+		if err := w.finishFile(); err != nil {
+			return nil, err
+		}
+	}
+	return w.outputs, nil
+}
+
+// Abort removes every file written so far, none of them has been registered yet.
+func (w *sstWriter) Abort() {
+	if w.file != nil {
+		w.file.Close()
+		w.f.fs.Remove(w.file.Name())
+	}
+	for _, meta := range w.outputs {
+		w.f.fs.Remove(filepath.Join(w.f.directory, meta.Name))
+	}
+}
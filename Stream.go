@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+/*
+SetStream stores a value read from an io.Reader without ever holding it in memory: the
+value is copied straight into a blob file of its own, which is registered in the manifest,
+and only then is a write of the blob pointer logged to the WAL and applied to the MemTable.
+The WAL therefore never holds the value and MaxEntrySize only bounds the key and the
+pointer. A crash between the two steps, or a failed write of the pointer, leaves a
+registered blob file no entry refers to: the next compaction removes it as garbage, or in a
+family that does not compact the next flush or Open. GetStream reads a value back through
+a ValueReader, an io.ReadCloser that knows the size of the value, from the blob file for
+blob entries, checking the CRC32C of the value once it has been read.
+Streamed values are not in the WAL either, a point-in-time recovery needs a base taken after them.
+*/
+
+var ErrKeyNotFound = errors.New("Key not found")
+
+var ErrValueTooLarge = errors.New("Value too large")
+
+// maxStreamSize is the largest value a blob pointer can refer to.
+const maxStreamSize = math.MaxUint32
+
+// ValueReader is the io.ReadCloser returned by GetStream, its Size is known before reading.
+type ValueReader struct {
+	r        io.Reader
+	file     File
+	size     int64
+	read     int64
+	blob     uint64
+	verify   bool
+	crc      uint32
+	checksum uint32
+}
+
+// Size returns the length of the value, the Content-Length of an HTTP response.
+func (v *ValueReader) Size() int64 {
+	return v.size
+}
+
+func (v *ValueReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.read += int64(n)
+	if v.file == nil {
+		return n, err
+	}
+	if v.verify {
+		v.crc = crc32.Update(v.crc, castagnoli, p[:n])
+	}
+	if err == io.EOF {
+		if v.read < v.size {
+			return n, fmt.Errorf("%w: blob file %d is truncated", ErrCorruption, v.blob)
+		}
+		if v.verify && v.crc != v.checksum {
+			return n, fmt.Errorf("%w: checksum mismatch in blob file %d", ErrCorruption, v.blob)
+		}
+	}
+	return n, err
+}
+
+func (v *ValueReader) Close() error {
+	if v.file == nil {
+		return nil
+	}
+	return v.file.Close()
+}
+
+// writeBlobStream copies size bytes of r into the new blob file number, holding key and the
+// value as a single record.
+func (f *FileManager) writeBlobStream(number uint64, key []byte, r io.Reader, size int64) (*blobMeta, blobPointer, error) {
+	meta := &blobMeta{Number: number}
+	w := &blobWriter{f: f, meta: meta}
+	file, err := f.fs.OpenFile(f.blobPath(number), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		fmt.Println("Error creating blob file")
+		return nil, blobPointer{}, err
+	}
+	w.file = file
+	header := append([]byte{}, blobMagic...)
+	header = appendBytes(header, key)
+	header = binary.AppendUvarint(header, uint64(size))
+	if _, err := file.Write(header); err != nil {
+		w.abort()
+		return nil, blobPointer{}, err
+	}
+	hasher := crc32.New(castagnoli)
+	n, err := io.Copy(io.MultiWriter(file, hasher), io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = fmt.Errorf("Expected a value of %d bytes, got %d", size, n)
+	}
+	if err != nil {
+		w.abort()
+		return nil, blobPointer{}, err
+	}
+	if f.SyncMode != SyncNone {
+		if err := file.Sync(); err != nil {
+			w.abort()
+			return nil, blobPointer{}, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		w.file = nil
+		w.abort()
+		return nil, blobPointer{}, err
+	}
+	w.file = nil
+	if err := f.syncDirectory(); err != nil {
+		w.abort()
+		return nil, blobPointer{}, err
+	}
+	meta.Size = int64(len(header)) + size
+	meta.Values = size
+	p := blobPointer{file: number, offset: uint64(len(header)), length: uint32(size), checksum: hasher.Sum32()}
+	return meta, p, nil
+}
+
+// SetStream stores the size bytes read from r as the value of key in the default column family.
+func (fl *FileDB) SetStream(key []byte, r io.Reader, size int64) error {
+	return fl.families[DefaultColumnFamily].SetStream(key, r, size)
+}
+
+// GetStream returns a reader of the value of key in the default column family.
+func (fl *FileDB) GetStream(key []byte) (*ValueReader, error) {
+	return fl.families[DefaultColumnFamily].GetStream(key)
+}
+
+// SetStream stores the size bytes read from r as the value of key. It fails when r ends
+// early; what r holds past size is not read.
+func (cf *ColumnFamily) SetStream(key []byte, r io.Reader, size int64) error {
+	db := cf.db
+	if db.readOnly {
+		return &ReadOnlyError{Op: "set"}
+	}
+	if len(key) == 0 {
+		return errors.New("Key cannot be empty")
+	}
+	if size < 0 {
+		return errors.New("Value size cannot be negative")
+	}
+	if size > maxStreamSize {
+		return ErrValueTooLarge
+	}
+	if cf.FileManager.keys != nil {
+		return errors.New("Streamed values are stored in blob files, which are not encrypted")
+	}
+	if len(key)+blobPointerSize+1 > db.MaxEntrySize {
+		return errors.New("Entry size too large")
+	}
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	f := cf.FileManager
+	number := f.nextFileNumber()
+	db.mu.Unlock()
+
+	// the copy runs without the lock, it takes as long as the client sending the value
+	meta, p, err := f.writeBlobStream(number, key, r, size)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	remove := func() {
+		f.fs.Remove(f.blobPath(number))
+	}
+	if db.closed {
+		remove()
+		return ErrClosed
+	}
+	if db.families[cf.Name] != cf {
+		remove()
+		return ErrColumnFamilyNotFound
+	}
+	previous := f.blobs
+	f.blobs = append(append([]*blobMeta{}, f.blobs...), meta)
+	if err := db.saveManifest(); err != nil {
+		f.blobs = previous
+		remove()
+		return err
+	}
+	b := NewWriteBatch()
+	b.ops = append(b.ops, batchOp{family: cf.Name, key: key, value: []byte(p.encode()), t: blobEntryType})
+	return db.write(b)
+}
+
+// GetStream returns a reader of the value of key, ErrKeyNotFound when there is none. The
+// reader must be closed; it keeps reading the value even if it is overwritten meanwhile.
+func (cf *ColumnFamily) GetStream(key []byte) (*ValueReader, error) {
+	cf.db.mu.Lock()
+	defer cf.db.unlock()
+	if cf.db.closed {
+		return nil, ErrClosed
+	}
+	e, _, ok, err := cf.db.find(cf, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if e.t != blobEntryType {
+		return &ValueReader{r: strings.NewReader(e.Value), size: int64(len(e.Value))}, nil
+	}
+	p, err := decodeBlobPointer(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	// an open file survives its removal by a compaction
+	file, err := cf.FileManager.fs.Open(cf.FileManager.blobPath(p.file))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening blob file %d: %w", p.file, err)
+	}
+	return &ValueReader{
+		r:        io.NewSectionReader(file, int64(p.offset), int64(p.length)),
+		file:     file,
+		size:     int64(p.length),
+		blob:     p.file,
+		verify:   DefaultReadOptions().VerifyChecksums,
+		checksum: p.checksum,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*
+The TableCache keeps the sstReaders of recently used SST files open so lookups neither
+re-open files nor re-parse their header, index and filter. It holds at most capacity
+readers; the least recently used one is closed when a new file has to be opened.
+It is shared by every column family of a FileDB and keyed by file path. Readers it opens
+share its BlockCache, and map their file into memory when mmap is set.
+get returns a reference to the reader that the caller releases with Close, so readers
+closed by the cache stay usable until their last user is done.
+*/
+
+type TableCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Open      int
+}
+
+type tableCacheEntry struct {
+	path   string
+	reader *sstReader
+}
+
+type TableCache struct {
+	capacity int
+	lru      *list.List
+	entries  map[string]*list.Element
+	stats    TableCacheStats
+	blocks   *BlockCache
+	mmap     bool
+	keys     KeyProvider
+	fs       VFS
+	mu       sync.Mutex
+}
+
+func NewTableCache(capacity int, blocks *BlockCache) *TableCache {
+	return &TableCache{
+		capacity: capacity,
+		blocks:   blocks,
+		fs:       OSFS{},
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *TableCache) get(path string) (*sstReader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(el)
+		reader := el.Value.(*tableCacheEntry).reader
+		reader.ref()
+		return reader, nil
+	}
+	c.stats.Misses++
+	reader, err := openSSTReader(c.fs, path, c.mmap, c.keys)
+	if err != nil {
+		return nil, err
+	}
+	if c.blocks != nil {
+		reader.blocks, reader.id = c.blocks, c.blocks.newID()
+	}
+	for c.lru.Len() >= c.capacity && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[path] = c.lru.PushFront(&tableCacheEntry{path: path, reader: reader})
+	reader.ref()
+	return reader, nil
+}
+
+// evict closes the reader of a file that is about to be deleted.
+func (c *TableCache) evict(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *TableCache) removeElement(el *list.Element) {
+	entry := c.lru.Remove(el).(*tableCacheEntry)
+	delete(c.entries, entry.path)
+	entry.reader.Close()
+}
+
+func (c *TableCache) Stats() TableCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Open = c.lru.Len()
+	return stats
+}
+
+func (c *TableCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
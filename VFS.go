@@ -0,0 +1,645 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+/*
+Every file the storage code touches goes through a VFS: SST, blob and WAL files, the
+manifest, the directory lock, checkpoints, backups, repairs and point-in-time recoveries.
+Options.FS selects it, nil being the operating system (OSFS). MemFS keeps everything in
+memory, for tests that must not touch the disk or that need to inspect or damage files
+directly. SST files are only memory mapped when the VFS hands out *os.File values.
+The configuration files, key files and export files of the command line stay on the OS.
+*/
+
+// File is an open file of a VFS, *os.File satisfies it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// VFS is the filesystem a database lives on. Errors follow the os package, so
+// os.IsNotExist and os.IsExist work on them.
+type VFS interface {
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	// ReadDir lists the entries of a directory sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	// Mkdir creates a directory, failing with an os.IsExist error when name exists.
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Link(oldname, newname string) error
+	Chtimes(name string, atime, mtime time.Time) error
+	// SyncDir makes the creations, renames and removals of entries in a directory durable.
+	SyncDir(name string) error
+	// Lock takes an exclusive lock on the file name without waiting, locked is false when
+	// someone else holds it. Closing the returned io.Closer releases it.
+	Lock(name string) (unlock io.Closer, locked bool, err error)
+}
+
+// OSFS is the VFS of the operating system.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (File, error) {
+	return fileOrNil(os.Open(name))
+}
+
+func (OSFS) Create(name string) (File, error) {
+	return fileOrNil(os.Create(name))
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return fileOrNil(os.OpenFile(name, flag, perm))
+}
+
+// fileOrNil keeps a failed open from returning a non-nil File holding a nil *os.File.
+func fileOrNil(file *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OSFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (OSFS) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (OSFS) Lock(name string) (io.Closer, bool, error) {
+	lock := flock.New(name)
+	locked, err := lock.TryLock()
+	if err != nil || !locked {
+		return nil, false, err
+	}
+	return lock, true, nil
+}
+
+/*
+MemFS is a VFS held in memory. Paths are cleaned and otherwise taken as they are, "." and
+"/" always exist. Hard links share their content, and like on Unix an open file keeps its
+content after being removed or replaced. Sync does nothing, nothing is ever lost.
+*/
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+type memNode struct {
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memNode), dirs: make(map[string]bool), locks: make(map[string]bool)}
+}
+
+func memPathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// isDir reports whether the cleaned path is a directory, the caller holds the lock.
+func (m *MemFS) isDir(path string) bool {
+	return path == "." || path == "/" || m.dirs[path]
+}
+
+// children returns the files and directories below the cleaned directory path.
+func (m *MemFS) children(path string) (files, dirs []string) {
+	prefix := path + string(filepath.Separator)
+	if path == "/" {
+		prefix = path
+	}
+	below := func(p string) bool {
+		return path == "." && !filepath.IsAbs(p) || strings.HasPrefix(p, prefix)
+	}
+	for p := range m.files {
+		if below(p) {
+			files = append(files, p)
+		}
+	}
+	for p := range m.dirs {
+		if below(p) {
+			dirs = append(dirs, p)
+		}
+	}
+	return files, dirs
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := filepath.Clean(name)
+	if m.isDir(path) {
+		return nil, memPathError("open", name, errors.New("is a directory"))
+	}
+	node, ok := m.files[path]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memPathError("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memPathError("open", name, os.ErrNotExist)
+	case !ok:
+		if !m.isDir(filepath.Dir(path)) {
+			return nil, memPathError("open", name, os.ErrNotExist)
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[path] = node
+	}
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	f := &memFile{
+		name:     name,
+		node:     node,
+		readable: access != os.O_WRONLY,
+		writable: access != os.O_RDONLY,
+		append:   flag&os.O_APPEND != 0,
+	}
+	if flag&os.O_TRUNC != 0 && f.writable {
+		node.mu.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.mu.Unlock()
+	}
+	return f, nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := filepath.Clean(oldpath), filepath.Clean(newpath)
+	if !m.isDir(filepath.Dir(to)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if node, ok := m.files[from]; ok {
+		if m.isDir(to) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+		}
+		delete(m.files, from)
+		m.files[to] = node
+		return nil
+	}
+	if !m.dirs[from] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := m.files[to]; ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	if files, dirs := m.children(to); m.isDir(to) && len(files)+len(dirs) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	if strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("invalid argument")}
+	}
+	files, dirs := m.children(from)
+	for _, p := range files {
+		m.files[to+strings.TrimPrefix(p, from)] = m.files[p]
+		delete(m.files, p)
+	}
+	for _, p := range dirs {
+		delete(m.dirs, p)
+		m.dirs[to+strings.TrimPrefix(p, from)] = true
+	}
+	delete(m.dirs, from)
+	m.dirs[to] = true
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := filepath.Clean(name)
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+	if !m.dirs[path] {
+		return memPathError("remove", name, os.ErrNotExist)
+	}
+	if files, dirs := m.children(path); len(files)+len(dirs) > 0 {
+		return memPathError("remove", name, errors.New("directory not empty"))
+	}
+	delete(m.dirs, path)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	delete(m.files, path)
+	if !m.dirs[path] {
+		return nil
+	}
+	files, dirs := m.children(path)
+	for _, p := range files {
+		delete(m.files, p)
+	}
+	for _, p := range dirs {
+		delete(m.dirs, p)
+	}
+	delete(m.dirs, path)
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := filepath.Clean(name)
+	if !m.isDir(path) {
+		return nil, memPathError("open", name, os.ErrNotExist)
+	}
+	files, dirs := m.children(path)
+	var infos []os.FileInfo
+	for _, p := range files {
+		if filepath.Dir(p) == path {
+			infos = append(infos, m.files[p].info(filepath.Base(p)))
+		}
+	}
+	for _, p := range dirs {
+		if filepath.Dir(p) == path {
+			infos = append(infos, memFileInfo{name: filepath.Base(p), dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := filepath.Clean(name)
+	if node, ok := m.files[path]; ok {
+		return node.info(filepath.Base(path)), nil
+	}
+	if m.isDir(path) {
+		return memFileInfo{name: filepath.Base(path), dir: true}, nil
+	}
+	return nil, memPathError("stat", name, os.ErrNotExist)
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := filepath.Clean(name)
+	if _, ok := m.files[path]; ok || m.isDir(path) {
+		return memPathError("mkdir", name, os.ErrExist)
+	}
+	if !m.isDir(filepath.Dir(path)) {
+		return memPathError("mkdir", name, os.ErrNotExist)
+	}
+	m.dirs[path] = true
+	return nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := filepath.Clean(path); !m.isDir(p); p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return memPathError("mkdir", path, errors.New("not a directory"))
+		}
+		m.dirs[p] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := m.files[from]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := m.files[to]; ok || m.isDir(to) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if !m.isDir(filepath.Dir(to)) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	m.files[to] = node
+	return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return memPathError("chtimes", name, os.ErrNotExist)
+	}
+	node.mu.Lock()
+	node.modTime = mtime
+	node.mu.Unlock()
+	return nil
+}
+
+func (m *MemFS) SyncDir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(filepath.Clean(name)) {
+		return memPathError("sync", name, os.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *MemFS) Lock(name string) (io.Closer, bool, error) {
+	path := filepath.Clean(name)
+	m.mu.Lock()
+	held := m.locks[path]
+	if !held {
+		m.locks[path] = true
+	}
+	m.mu.Unlock()
+	if held {
+		return nil, false, nil
+	}
+	// like flock, the lock file is created if needed
+	file, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		m.unlock(path)
+		return nil, false, err
+	}
+	file.Close()
+	return memLock{fs: m, path: path}, true, nil
+}
+
+func (m *MemFS) unlock(path string) {
+	m.mu.Lock()
+	delete(m.locks, path)
+	m.mu.Unlock()
+}
+
+type memLock struct {
+	fs   *MemFS
+	path string
+}
+
+func (l memLock) Close() error {
+	l.fs.unlock(l.path)
+	return nil
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return memFileInfo{name: name, size: int64(len(n.data)), modTime: n.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// memFile is an open file of a MemFS, reads and writes share its offset like with os.File.
+type memFile struct {
+	name     string
+	node     *memNode
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return memPathError(op, f.name, os.ErrClosed)
+	}
+	if !allowed {
+		return memPathError(op, f.name, errors.New("bad file descriptor"))
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memPathError("readat", f.name, errors.New("negative offset"))
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return memPathError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", true)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.writable); err != nil {
+		return err
+	}
+	if size < 0 {
+		return memPathError("truncate", f.name, errors.New("invalid argument"))
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// writeFileAtomic writes content to a temporary file, renames it to path and syncs the
+// directory so the rename survives a crash.
+func writeFileAtomic(fs VFS, path string, content []byte) error {
+	tmp := path + ".tmp"
+	file, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(path))
+}
+
+// readFile returns the content of the file name of fs.
+func readFile(fs VFS, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
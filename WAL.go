@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+The WAL type is the write-ahead log shared by every column family of a FileDB.
+Every record holds one encoded WriteBatch, so a batch spanning several families is
+replayed entirely or not at all.
+Record layout: 4 bytes payload length | 4 bytes crc32c of the payload | payload
+The payload is the sequence number of the write (8 bytes), its time in unix nanoseconds
+(8 bytes) and the encoded batch. Sequence numbers grow by one with every write and survive
+restarts through the manifest, so the records of successive logs form a single history.
+The file starts with walMagic. Logs starting with walMagicV1 hold records without sequence
+number and time, and a log with no magic at all was written before column families existed
+(2 bytes length | type | key=value) and is replayed into the default family.
+When archive is set the log is copied there, as <sequence of its first record>.wal, before
+every Reset, which is what point-in-time recovery replays.
+With a KeyProvider the log starts with walMagicEncrypted and the key header of the active
+key instead, and every payload is sealed with that key (see Encryption.go). The key is
+picked whenever the log is emptied, so a rotated key applies from the next flush.
+*/
+
+var walMagic = []byte("LENTAWL2")
+var walMagicV1 = []byte("LENTAWAL")
+var walMagicEncrypted = []byte("LENTAWLE")
+
+const walRecordHeader = 16
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type WAL struct {
+	file    File
+	fs      VFS
+	sync    bool
+	legacy  bool   // the log started with walMagicV1, its records have no sequence number
+	archive string // directory receiving the log before it is emptied, none when empty
+	first   uint64 // sequence number of the first record of the log, 0 while it is empty
+	keys    KeyProvider
+	enc     *encryptor // seals the records of an encrypted log
+}
+
+// walRecord is one write read back from a log.
+type walRecord struct {
+	Sequence uint64 // 0 for records of a log without sequence numbers
+	Time     time.Time
+	Batch    *WriteBatch
+}
+
+func openWAL(fs VFS, path string, keys KeyProvider) (*WAL, error) {
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, errors.New("Error opening log file")
+	}
+	w := &WAL{file: file, fs: fs, keys: keys}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		// a new log must survive a crash before the first write relies on it
+		err := w.start()
+		if err == nil {
+			err = file.Sync()
+		}
+		if err == nil {
+			err = fs.SyncDir(filepath.Dir(path))
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+	start := make([]byte, len(walMagic)+keyHeaderSize)
+	n, _ := file.ReadAt(start, 0)
+	_, w.legacy, w.enc, _, err = logStart(start[:n], keys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// start writes the magic of an empty log, followed by the key header of the active key when
+// the log is encrypted.
+func (w *WAL) start() error {
+	enc, err := activeEncryptor(w.keys)
+	if err != nil {
+		return err
+	}
+	w.enc = enc
+	magic := walMagic
+	if enc != nil {
+		magic = append(append([]byte{}, walMagicEncrypted...), enc.header()...)
+	}
+	_, err = w.file.Write(magic)
+	return err
+}
+
+// logStart parses the beginning of a log: the offset of its first record, whether its
+// records lack sequence numbers and the encryptor of an encrypted log. ok is false for a log
+// written before column families, which has no magic.
+func logStart(content []byte, keys KeyProvider) (offset int, legacy bool, enc *encryptor, ok bool, err error) {
+	switch {
+	case bytes.HasPrefix(content, walMagic):
+		return len(walMagic), false, nil, true, nil
+	case bytes.HasPrefix(content, walMagicV1):
+		return len(walMagicV1), true, nil, true, nil
+	case bytes.HasPrefix(content, walMagicEncrypted):
+		enc, err = readKeyHeader(content[len(walMagicEncrypted):], keys)
+		if err != nil {
+			return 0, false, nil, true, fmt.Errorf("Log file: %w", err)
+		}
+		return len(walMagicEncrypted) + keyHeaderSize, false, enc, true, nil
+	}
+	return 0, false, nil, false, nil
+}
+
+// openWALReadOnly opens an existing log for replay only, it returns a nil WAL when there is none.
+func openWALReadOnly(fs VFS, path string, keys KeyProvider) (*WAL, error) {
+	file, err := fs.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error opening log file")
+	}
+	return &WAL{file: file, fs: fs, keys: keys}, nil
+}
+
+// Append logs the batch encoded in payload as write seq made at ts.
+func (w *WAL) Append(seq uint64, ts time.Time, payload []byte) error {
+	header := 0
+	if !w.legacy {
+		header = walRecordHeader
+	}
+	body := make([]byte, header+len(payload))
+	if header != 0 {
+		binary.BigEndian.PutUint64(body, seq)
+		binary.BigEndian.PutUint64(body[8:], uint64(ts.UnixNano()))
+	}
+	copy(body[header:], payload)
+	if w.enc != nil {
+		body = w.enc.seal(body, nil)
+	}
+	record := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(body, castagnoli))
+	record = append(record, body...)
+	_, err := w.file.Write(record)
+	if err != nil {
+		fmt.Println("Error writing to log file")
+		return err
+	}
+	if w.first == 0 {
+		w.first = seq
+	}
+	if w.sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// openWALRecord decodes the payload of a record, decrypting it first when the log is encrypted.
+func openWALRecord(payload []byte, legacy bool, enc *encryptor) (walRecord, error) {
+	if enc != nil {
+		plaintext, err := enc.open(payload, nil)
+		if err != nil {
+			return walRecord{}, err
+		}
+		payload = plaintext
+	}
+	return decodeWALRecord(payload, legacy)
+}
+
+// decodeWALRecord decodes the payload of a record, legacy payloads only hold the batch.
+func decodeWALRecord(payload []byte, legacy bool) (walRecord, error) {
+	if legacy {
+		batch, err := decodeWriteBatch(payload)
+		return walRecord{Batch: batch}, err
+	}
+	if len(payload) < walRecordHeader {
+		return walRecord{}, errors.New("Malformed log record")
+	}
+	batch, err := decodeWriteBatch(payload[walRecordHeader:])
+	return walRecord{
+		Sequence: binary.BigEndian.Uint64(payload),
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:]))),
+		Batch:    batch,
+	}, err
+}
+
+// Replay calls fn for every complete record in the log, oldest first.
+// A torn or corrupted record ends the replay: nothing after it was acknowledged as a whole.
+func (w *WAL) Replay(fn func(walRecord) error) error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	content := make([]byte, info.Size())
+	if _, err := w.file.ReadAt(content, 0); err != nil && err != io.EOF {
+		return err
+	}
+	offset, legacy, enc, ok, err := logStart(content, w.keys)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return replayLegacyLog(content, func(b *WriteBatch) error {
+			return fn(walRecord{Batch: b})
+		})
+	}
+	for offset+8 <= len(content) {
+		size := int(binary.BigEndian.Uint32(content[offset:]))
+		sum := binary.BigEndian.Uint32(content[offset+4:])
+		if offset+8+size > len(content) {
+			fmt.Println("Ignoring torn record at the end of the log")
+			break
+		}
+		payload := content[offset+8 : offset+8+size]
+		if crc32.Checksum(payload, castagnoli) != sum {
+			fmt.Println("Ignoring corrupted log record at offset", offset)
+			break
+		}
+		record, err := openWALRecord(payload, legacy, enc)
+		if err != nil {
+			return err
+		}
+		if w.first == 0 {
+			w.first = record.Sequence
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+		offset += 8 + size
+	}
+	return nil
+}
+
+func replayLegacyLog(content []byte, fn func(*WriteBatch) error) error {
+	batch := NewWriteBatch()
+	offset := 0
+	for offset+2 <= len(content) {
+		entrySize := int(binary.BigEndian.Uint16(content[offset:]))
+		if entrySize == 0 || offset+2+entrySize > len(content) {
+			break
+		}
+		entry := decodeEntry(content[offset+2 : offset+2+entrySize])
+		if entry.t == 0 {
+			batch.Set(DefaultColumnFamily, []byte(entry.Key), []byte(entry.Value))
+		} else {
+			batch.Del(DefaultColumnFamily, []byte(entry.Key))
+		}
+		offset += entrySize + 2
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return fn(batch)
+}
+
+// Reset empties the log once every family has been flushed to SST files, archiving it first.
+func (w *WAL) Reset() error {
+	if w.archive != "" && w.first != 0 {
+		if err := w.archiveLog(); err != nil {
+			fmt.Println("Error archiving log file")
+			return err
+		}
+	}
+	if err := w.file.Truncate(0); err != nil {
+		fmt.Println("Error truncating log file")
+		return err
+	}
+	w.legacy = false
+	w.first = 0
+	return w.start()
+}
+
+// archiveLog copies the log into the archive directory. A crash before the following
+// truncation replays and archives the same records again under the same name.
+func (w *WAL) archiveLog() error {
+	if err := w.fs.MkdirAll(w.archive, 0755); err != nil {
+		return err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	content := make([]byte, info.Size())
+	if _, err := w.file.ReadAt(content, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if err := writeFileAtomic(w.fs, filepath.Join(w.archive, fmt.Sprintf("%020d.wal", w.first)), content); err != nil {
+		return err
+	}
+	return w.fs.SyncDir(w.archive)
+}
+
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+A WriteBatch groups Set and Del operations, possibly across several column families,
+that are logged as a single WAL record and applied atomically by FileDB.Write.
+Encoding: uvarint count, then for every operation
+type (1 byte) | uvarint len + family | uvarint len + key | uvarint len + value
+*/
+
+type batchOp struct {
+	family string
+	key    []byte
+	value  []byte
+	t      int
+}
+
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Set(family string, key, value []byte) {
+	b.ops = append(b.ops, batchOp{family: family, key: key, value: value, t: 0})
+}
+
+func (b *WriteBatch) Del(family string, key []byte) {
+	b.ops = append(b.ops, batchOp{family: family, key: key, t: 1})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(b.ops)))
+	for _, op := range b.ops {
+		buf = append(buf, byte(op.t))
+		buf = appendBytes(buf, []byte(op.family))
+		buf = appendBytes(buf, op.key)
+		buf = appendBytes(buf, op.value)
+	}
+	return buf
+}
+
+func appendBytes(buf, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, errors.New("Malformed batch record")
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], nil
+}
+
+func decodeWriteBatch(buf []byte) (*WriteBatch, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errors.New("Malformed batch record")
+	}
+	buf = buf[n:]
+	b := NewWriteBatch()
+	for i := uint64(0); i < count; i++ {
+		if len(buf) < 1 {
+			return nil, errors.New("Malformed batch record")
+		}
+		op := batchOp{t: int(buf[0])}
+		family, rest, err := readBytes(buf[1:])
+		if err != nil {
+			return nil, err
+		}
+		if op.key, rest, err = readBytes(rest); err != nil {
+			return nil, err
+		}
+		if op.value, rest, err = readBytes(rest); err != nil {
+			return nil, err
+		}
+		op.family = string(family)
+		b.ops = append(b.ops, op)
+		buf = rest
+	}
+	return b, nil
+}
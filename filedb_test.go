@@ -2,9 +2,23 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSet(t *testing.T) {
@@ -14,14 +28,31 @@ func TestSet(t *testing.T) {
 	t.Run("WriteAndVerifyFiles", testWriteAndVerifyFiles)
 }
 
-func testLargeEntrySizeError(t *testing.T) {
-	f1, err := NewFileManager()
+func TestOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemTableSize = 0
+	if _, err := Open(t.TempDir(), opts); err == nil {
+		t.Error("Expected an error for a zero MemTableSize, but got nil")
+	}
+	t.Setenv("CACHE_SIZE", "abc")
+	if _, _, err := LoadOptions(nil); err == nil {
+		t.Error("Expected an error for an invalid CACHE_SIZE, but got nil")
+	}
+	t.Setenv("CACHE_SIZE", "42")
+	t.Setenv("SYNC_MODE", "always")
+	dir, opts, err := LoadOptions([]string{"-dir", "other", "-sync", "none"})
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	db, err := NewFileDB(f1)
+	if dir != "other" || opts.MemTableSize != 42 || opts.SyncMode != SyncNone {
+		t.Errorf("Unexpected options: %s %+v", dir, opts)
+	}
+}
+
+func testLargeEntrySizeError(t *testing.T) {
+	db, err := Open(t.TempDir(), nil)
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
 	db.MaxEntrySize = 100
@@ -35,13 +66,9 @@ func testLargeEntrySizeError(t *testing.T) {
 }
 
 func testValidEntry(t *testing.T) {
-	f1, err := NewFileManager()
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
-	}
-	db, err := NewFileDB(f1)
+	db, err := Open(t.TempDir(), nil)
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 	db.MaxEntrySize = 100
 	db.CacheSize = 100
@@ -54,15 +81,10 @@ func testValidEntry(t *testing.T) {
 }
 
 func testCacheOverflow(t *testing.T) {
-	f1, err := NewFileManager()
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
-	}
-
 	// Test case 3: Cache overflow
-	db, err := NewFileDB(f1)
+	db, err := Open(t.TempDir(), nil)
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
 	db.MaxEntrySize = 100
@@ -98,3 +120,2042 @@ func testWriteAndVerifyFiles(t *testing.T) {
 		t.Errorf("Unexpected error reading SST header: %v", err)
 	}
 }
+
+func openTestDB(t *testing.T, dir string) *FileDB {
+	opts := DefaultOptions()
+	opts.MaxEntrySize = 100
+	opts.MemTableSize = 100
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return db
+}
+
+// simulateCrash releases a database without flushing anything, as if the process had died.
+func simulateCrash(db *FileDB) {
+	db.wal.Close()
+	db.lock.Close()
+}
+
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := Open(dir, nil); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("Expected ErrDatabaseLocked, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Expected the lock to be released on Close, got %v", err)
+	}
+	db.Close()
+}
+
+func TestColumnFamilies(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	users, err := db.CreateFamily("users", &ColumnFamilyOptions{CacheSize: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Set([]byte("k"), []byte("default")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	batch := NewWriteBatch()
+	batch.Set("users", []byte("k"), []byte("users"))
+	batch.Set("users", []byte("a"), []byte("b=c"))
+	batch.Del(DefaultColumnFamily, []byte("missing"))
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	batch = NewWriteBatch()
+	batch.Set("nope", []byte("k"), []byte("v"))
+	if err := db.Write(batch); err != ErrColumnFamilyNotFound {
+		t.Errorf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+	if v, _ := users.Get([]byte("k")); string(v) != "users" {
+		t.Errorf("Expected users, got %q", v)
+	}
+
+	// reopen without flushing: both families are recovered from the shared WAL
+	simulateCrash(db)
+	db = openTestDB(t, dir)
+	if v, _ := db.Get([]byte("k")); string(v) != "default" {
+		t.Errorf("Expected default, got %q", v)
+	}
+	users, err = db.Family("users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if users.Options.CacheSize != 2 {
+		t.Errorf("Expected options to be persisted, got %+v", users.Options)
+	}
+	if v, _ := users.Get([]byte("a")); string(v) != "b=c" {
+		t.Errorf("Expected b=c, got %q", v)
+	}
+	if err := db.DropFamily("users"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := db.Family("users"); err != ErrColumnFamilyNotFound {
+		t.Errorf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+}
+
+func TestFileRollover(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MaxFileSize = 1024
+	opts.MemTableSize = 150
+	opts.CompactionTrigger = 2
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 600; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		if err := db.Set(key, []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	files := db.FileManager.files
+	if len(files) < 2 {
+		t.Fatalf("Expected several SST files, got %d", len(files))
+	}
+	if files[0].Level != 1 {
+		t.Errorf("Expected the oldest files to come from a compaction")
+	}
+	for _, meta := range files {
+		info, err := os.Stat(db.FileManager.path(meta))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if info.Size() > opts.MaxFileSize {
+			t.Errorf("File %s is %d bytes, larger than %d", meta.Name, info.Size(), opts.MaxFileSize)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 600; i++ {
+		v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil || string(v) != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value%d, got %q (%v)", i, v, err)
+		}
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	if err := db.Set([]byte("flushed"), []byte("1")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.flush(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Set([]byte("logged"), []byte("2")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	logInfo, err := os.Stat(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the writer still holds the lock, a reader does not need it
+	ro, err := OpenReadOnly(dir, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ro.Close()
+	for key, want := range map[string]string{"flushed": "1", "logged": "2"} {
+		if v, _ := ro.Get([]byte(key)); string(v) != want {
+			t.Errorf("Expected %s, got %q", want, v)
+		}
+	}
+	var roErr *ReadOnlyError
+	if err := ro.Set([]byte("k"), []byte("v")); !errors.As(err, &roErr) {
+		t.Errorf("Expected a ReadOnlyError, got %v", err)
+	}
+	if _, err := ro.Del([]byte("flushed")); !errors.As(err, &roErr) {
+		t.Errorf("Expected a ReadOnlyError, got %v", err)
+	}
+	after, err := os.Stat(filepath.Join(dir, "log"))
+	if err != nil || after.Size() != logInfo.Size() {
+		t.Errorf("Expected the log to be left untouched")
+	}
+
+	noLog, err := OpenReadOnly(dir, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer noLog.Close()
+	if v, _ := noLog.Get([]byte("logged")); v != nil {
+		t.Errorf("Expected the WAL not to be replayed, got %q", v)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Set([]byte("k"), []byte("v")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if _, err := db.Get([]byte("k")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "log"))
+	if err != nil || info.Size() != int64(len(walMagic)) {
+		t.Errorf("Expected Close to flush the WAL")
+	}
+	db = openTestDB(t, dir)
+	defer db.Close()
+	if v, _ := db.Get([]byte("k")); string(v) != "v" {
+		t.Errorf("Expected v, got %q", v)
+	}
+}
+
+func TestTableCache(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxFileSize = 1024
+	opts.BlockSize = 128
+	opts.MemTableSize = 100
+	opts.MaxOpenFiles = 2
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 500; i++ {
+			v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+			if err != nil || string(v) != "value"+strconv.Itoa(i) {
+				t.Fatalf("Expected value%d, got %q (%v)", i, v, err)
+			}
+		}
+	}
+	if v, _ := db.Get([]byte("missing")); v != nil {
+		t.Errorf("Expected no value, got %q", v)
+	}
+	stats := db.TableCacheStats()
+	if stats.Open > 2 {
+		t.Errorf("Expected at most 2 open files, got %d", stats.Open)
+	}
+	if stats.Hits == 0 || stats.Misses == 0 || stats.Evictions == 0 {
+		t.Errorf("Unexpected table cache stats %+v", stats)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BlockSize = 128
+	opts.MemTableSize = 100
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// reads that must not fill the cache
+	for i := 0; i < 100; i++ {
+		v, err := db.GetWithOptions([]byte("key"+strconv.Itoa(i)), &ReadOptions{DontFillCache: true})
+		if err != nil || string(v) != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value%d, got %q (%v)", i, v, err)
+		}
+	}
+	if stats := db.BlockCacheStats(); stats.Inserts != 0 || stats.Usage != 0 {
+		t.Errorf("Expected an empty block cache, got %+v", stats)
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+			if err != nil || string(v) != "value"+strconv.Itoa(i) {
+				t.Fatalf("Expected value%d, got %q (%v)", i, v, err)
+			}
+		}
+	}
+	stats := db.BlockCacheStats()
+	if stats.Inserts == 0 || stats.Usage == 0 || stats.Usage > stats.Capacity {
+		t.Errorf("Unexpected block cache stats %+v", stats)
+	}
+	if stats.HitRatio() < 0.5 {
+		t.Errorf("Expected a hit ratio of at least 0.5, got %f", stats.HitRatio())
+	}
+
+	cache := NewBlockCache(blockCacheShards * 100)
+	for i := 0; i < 1000; i++ {
+		cache.insert(blockKey{file: 1, offset: int64(i)}, nil, 30)
+	}
+	if stats := cache.Stats(); stats.Usage > stats.Capacity || stats.Evictions == 0 {
+		t.Errorf("Expected the cache to stay within its capacity, got %+v", stats)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxFileSize = 1024
+	opts.MemTableSize = 100
+	opts.CompactionTrigger = 2
+	opts.UseMmap = true
+	dir := t.TempDir()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 150; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// a reader still referenced when compaction deletes its file keeps working
+	meta := db.FileManager.files[0]
+	reader, err := db.FileManager.reader(meta)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mmapSupported && reader.data == nil {
+		t.Errorf("Expected the file to be mapped")
+	}
+	for i := 150; i < 400; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, meta.Name)); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed by compaction", meta.Name)
+	}
+	e, ok, err := reader.Get(meta.Smallest, nil)
+	if err != nil || !ok || e.Key != string(meta.Smallest) {
+		t.Errorf("Expected %s from the deleted file, got %+v %v (%v)", meta.Smallest, e, ok, err)
+	}
+	reader.Close()
+	for i := 0; i < 400; i++ {
+		v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil || string(v) != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected value%d, got %q (%v)", i, v, err)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	block := bytes.Repeat([]byte(`{"user":"lenta","tags":["a","b"],"active":true}`), 50)
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecLZ} {
+		stored := encodeBlock(codec, block)
+		if codec != CodecNone && len(stored) > len(block)/3 {
+			t.Errorf("Expected %s to compress the block at least 3x, got %d bytes", codec, len(stored))
+		}
+		raw, err := decodeBlock(stored)
+		if err != nil || !bytes.Equal(raw, block) {
+			t.Errorf("Expected %s to round trip, got %v", codec, err)
+		}
+	}
+	// incompressible blocks are kept raw
+	random := make([]byte, 256)
+	for i := range random {
+		random[i] = byte(i*7919 + i*i*31)
+	}
+	if stored := encodeBlock(CodecLZ, random); Codec(stored[len(stored)-1]) != CodecNone {
+		t.Errorf("Expected an incompressible block to be stored raw")
+	}
+	// a literal longer than the announced size must not let a copy length wrap around
+	corrupt := []byte{1, 0, 4, 'a', 'b', 'c', 'd', 1, 1}
+	corrupt = binary.AppendUvarint(corrupt, 1<<62)
+	if _, err := lzDecompress(corrupt); err == nil {
+		t.Errorf("Expected a corrupt lz block to be rejected")
+	}
+
+	opts := DefaultOptions()
+	opts.MemTableSize = 100
+	opts.CompactionTrigger = 2
+	opts.Compression = []Codec{CodecNone, CodecFlate}
+	dir := t.TempDir()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	value := string(block[:150])
+	for i := 0; i < 350; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte(value)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for _, meta := range db.FileManager.files {
+		reader, err := db.FileManager.reader(meta)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if want := opts.Compression[meta.Level]; reader.header.Codec != want {
+			t.Errorf("Expected level %d to use %s, got %s", meta.Level, want, reader.header.Codec)
+		}
+		reader.Close()
+	}
+	db.Close()
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 350; i++ {
+		v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		if err != nil || string(v) != value {
+			t.Fatalf("Expected the value of key%d, got %q (%v)", i, v, err)
+		}
+	}
+}
+
+func TestPrefixCompression(t *testing.T) {
+	b := newBlockBuilder(4)
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("tenant/1234/order/%04d", i*2))
+	}
+	full := 0
+	for _, k := range keys {
+		e := Entry{Key: k, Value: "v" + k}
+		b.add(e)
+		full += len(e.toBytes())
+	}
+	block := b.finish()
+	if len(block) > full*3/4 {
+		t.Errorf("Expected shared prefixes to be dropped, block has %d bytes", len(block))
+	}
+	entries, err := decodePrefixBlock(block)
+	if err != nil || len(entries) != len(keys) {
+		t.Fatalf("Expected %d entries, got %d (%v)", len(keys), len(entries), err)
+	}
+	for i, e := range entries {
+		if e.Key != keys[i] || e.Value != "v"+keys[i] {
+			t.Errorf("Expected %s, got %+v", keys[i], e)
+		}
+	}
+	for i := -1; i <= 100; i++ {
+		key := fmt.Sprintf("tenant/1234/order/%04d", i)
+		e, ok, err := seekPrefixBlock(block, []byte(key))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if want := i >= 0 && i < 100 && i%2 == 0; ok != want || (ok && e.Key != key) {
+			t.Errorf("Expected %s found=%v, got %+v %v", key, want, e, ok)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.MemTableSize = 100
+	opts.BlockRestartInterval = 4
+	opts.BlockCacheSize = 0
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("tenant/1234/order=%d", i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("tenant/1234/order=%d", i)))
+		if err != nil || string(v) != strconv.Itoa(i) {
+			t.Fatalf("Expected %d, got %q (%v)", i, v, err)
+		}
+	}
+}
+
+func TestBlockChecksums(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemTableSize = 100
+	opts.BlockSize = 128
+	opts.BlockCacheSize = 0
+	opts.Compression = []Codec{CodecNone}
+	dir := t.TempDir()
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	db.Close()
+	path := filepath.Join(dir, db.FileManager.files[0].Name)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.FileManager.ValidateFile(file); err != nil {
+		t.Errorf("Expected a valid file, got %v", err)
+	}
+	file.Close()
+
+	// damage a value of the first data block
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	i := bytes.Index(data, []byte("value0"))
+	data[i+len("value")] = 'X'
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the callback runs once the lock is released, so it may use the database
+	var health []HealthStatus
+	opts.OnCorruption = func(e CorruptionEvent) { health = append(health, db.Health()) }
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Get([]byte("key0")); !errors.Is(err, ErrCorruption) {
+		t.Errorf("Expected ErrCorruption, got %v", err)
+	}
+	if len(health) != 1 || health[0].Status != "degraded" || len(health[0].Corruptions) != 1 {
+		t.Errorf("Unexpected health from the callback %+v", health)
+	}
+	v, err := db.GetWithOptions([]byte("key0"), &ReadOptions{})
+	if err != nil || string(v) != "valueX" {
+		t.Errorf("Expected the damaged value without verification, got %q (%v)", v, err)
+	}
+	// blocks other than the damaged one are still readable
+	if v, err := db.Get([]byte("key99")); err != nil || string(v) != "value99" {
+		t.Errorf("Expected value99, got %q (%v)", v, err)
+	}
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer file.Close()
+	if err := db.FileManager.ValidateFile(file); !errors.Is(err, ErrCorruption) {
+		t.Errorf("Expected ErrCorruption, got %v", err)
+	}
+}
+
+func TestCorruptionPolicy(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MemTableSize = 50
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 120; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	db.Close()
+	bad := db.FileManager.files[0]
+	path := filepath.Join(dir, bad.Name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := Open(dir, opts); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+
+	opts.CorruptionPolicy = CorruptionReadOnly
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var readOnly *ReadOnlyError
+	if err := db.Set([]byte("key"), []byte("value")); !errors.As(err, &readOnly) {
+		t.Errorf("Expected a ReadOnlyError, got %v", err)
+	}
+	if health := db.Health(); health.Status != "read-only" || len(health.Corruptions) != 1 {
+		t.Errorf("Unexpected health %+v", health)
+	}
+	db.Close()
+
+	var events []CorruptionEvent
+	opts.CorruptionPolicy = CorruptionQuarantine
+	opts.OnCorruption = func(e CorruptionEvent) { events = append(events, e) }
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0].File != bad.Name || events[0].Action != "quarantine" || events[0].Smallest != string(bad.Smallest) {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lostDirectory, bad.Name)); err != nil {
+		t.Errorf("Expected %s to be quarantined: %v", bad.Name, err)
+	}
+	if health := db.Health(); health.Status != "degraded" || health.ReadOnly {
+		t.Errorf("Unexpected health %+v", health)
+	}
+	if err := db.Set([]byte("key"), []byte("value")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if v, err := db.Get([]byte("key119")); err != nil || string(v) != "value119" {
+		t.Errorf("Expected value119, got %q (%v)", v, err)
+	}
+	db.Close()
+
+	// the quarantined file is no longer registered
+	opts.CorruptionPolicy = CorruptionFail
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	if health := db.Health(); health.Status != "ok" {
+		t.Errorf("Unexpected health %+v", health)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MemTableSize = 100
+	opts.BlockSize = 128
+	opts.Compression = []Codec{CodecNone}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	users, err := db.CreateFamily("users", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 150; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := users.Set([]byte(fmt.Sprintf("user%03d", i)), []byte("name")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("wal%d", i)), []byte("pending")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	files := append([]*fileMeta(nil), db.FileManager.files...)
+	simulateCrash(db)
+
+	// damage a block of the first file and the middle record of the WAL
+	damage := func(path string, marker string) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		i := bytes.Index(data, []byte(marker))
+		if i < 0 {
+			t.Fatalf("%s not found in %s", marker, path)
+		}
+		data[i] ^= 0xff
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	damage(filepath.Join(dir, files[0].Name), "value000")
+	damage(db.FileManager.logPath(), "wal1")
+
+	report, err := Repair(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !report.Lost() || report.WAL.Batches == 0 || report.WAL.LostRecords != 1 {
+		t.Errorf("Unexpected WAL report %+v", report.WAL)
+	}
+	var lost []LostRange
+	for _, family := range report.Families {
+		for _, file := range family.Files {
+			lost = append(lost, file.LostBlocks...)
+		}
+	}
+	if len(lost) != 1 || lost[0].After != "" {
+		t.Errorf("Expected the first block to be lost, got %+v", lost)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lostDirectory, files[0].Name)); err != nil {
+		t.Errorf("Expected the damaged file in lost/: %v", err)
+	}
+	if reports, _ := filepath.Glob(filepath.Join(dir, "REPAIR-*.json")); len(reports) != 1 {
+		t.Errorf("Expected a repair report, got %v", reports)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	if v, err := db.Get([]byte("key000")); err != nil || v != nil {
+		t.Errorf("Expected key000 to be lost, got %q (%v)", v, err)
+	}
+	if v, err := db.Get([]byte("key149")); err != nil || string(v) != "value149" {
+		t.Errorf("Expected value149, got %q (%v)", v, err)
+	}
+	for _, key := range []string{"wal0", "wal2"} {
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != "pending" {
+			t.Errorf("Expected %s to be salvaged from the WAL, got %q (%v)", key, v, err)
+		}
+	}
+	users, err = db.Family("users")
+	if err != nil {
+		t.Fatalf("Expected the users family to survive the repair: %v", err)
+	}
+	if v, err := users.Get([]byte("user149")); err != nil || string(v) != "name" {
+		t.Errorf("Expected user149, got %q (%v)", v, err)
+	}
+
+	// an old copy of the data in lost/ and an unregistered one, and a WAL whose emptying
+	// after the last flush did not survive, must not bring back old values
+	old := db.FileManager.path(db.FileManager.files[len(db.FileManager.files)-1])
+	copyTo := func(src, dst string) {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	copyTo(old, filepath.Join(dir, lostDirectory, "99999999999999999998.sst"))
+	copyTo(old, filepath.Join(dir, "99999999999999999999.sst"))
+	db.Set([]byte("key149"), []byte("old"))
+	db.Sync()
+	stale := filepath.Join(t.TempDir(), "log")
+	copyTo(db.FileManager.logPath(), stale)
+	db.Set([]byte("key149"), []byte("newer"))
+	db.Del([]byte("key148"))
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	copyTo(stale, db.FileManager.logPath())
+	check := func(key, want string) {
+		t.Helper()
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer db.Close()
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != want {
+			t.Errorf("Expected %q for %s, got %q (%v)", want, key, v, err)
+		}
+	}
+	report, err = Repair(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.WAL.Skipped != 1 {
+		t.Errorf("Expected the stale WAL batch to be skipped, got %+v", report.WAL)
+	}
+	check("key149", "newer")
+	check("key148", "")
+	if _, err := RepairWithOptions(dir, opts, RepairOptions{Unregistered: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("key148", "value148")
+}
+
+func TestSSTDump(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.BlockSize = 64
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, err := db.Del([]byte("key3")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db.Close()
+	path := filepath.Join(dir, db.FileManager.files[0].Name)
+
+	var out bytes.Buffer
+	if err := dumpSST(&out, path, nil, false, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, want := range []string{`magic:     "LENTASST"`, "version:   5", `put "key0" = "value0"`, `del "key3"`, "block 1: offset", "file checksum: ok"} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("Expected %q in the dump:\n%s", want, out.String())
+		}
+	}
+	out.Reset()
+	if err := dumpSST(&out, path, nil, true, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, want := range []string{"records:   10 (9 puts, 1 tombstones)", "keys: min 4, avg 4.0, max 4 bytes"} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("Expected %q in the stats:\n%s", want, out.String())
+		}
+	}
+	if bytes.Contains(out.Bytes(), []byte("put ")) {
+		t.Errorf("Expected no records in the stats:\n%s", out.String())
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateFamily("users", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := users.Set([]byte("alice"), []byte("admin")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	target := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(target); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Checkpoint(target); !errors.Is(err, ErrCheckpointExists) {
+		t.Errorf("Expected ErrCheckpointExists, got %v", err)
+	}
+	// writes after the checkpoint are not part of it
+	if err := db.Set([]byte("later"), []byte("value")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	meta := db.FileManager.files[0]
+	live, _ := os.Stat(filepath.Join(dir, meta.Name))
+	linked, err := os.Stat(filepath.Join(target, meta.Name))
+	if err != nil || !os.SameFile(live, linked) {
+		t.Errorf("Expected %s to be hard-linked into the checkpoint (%v)", meta.Name, err)
+	}
+
+	cp, err := Open(target, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer cp.Close()
+	for i := 0; i < 10; i++ {
+		if v, err := cp.Get([]byte("key" + strconv.Itoa(i))); err != nil || string(v) != "value"+strconv.Itoa(i) {
+			t.Errorf("Expected value%d, got %q (%v)", i, v, err)
+		}
+	}
+	if v, _ := cp.Get([]byte("later")); v != nil {
+		t.Errorf("Expected no value for a write after the checkpoint, got %q", v)
+	}
+	cpUsers, err := cp.Family("users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v, err := cpUsers.Get([]byte("alice")); err != nil || string(v) != "admin" {
+		t.Errorf("Expected admin, got %q (%v)", v, err)
+	}
+
+	// a directory left by an interrupted checkpoint is kept
+	leftover := filepath.Join(t.TempDir(), "other")
+	if err := os.Mkdir(leftover+".tmp", 0755); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := db.Checkpoint(leftover); !errors.Is(err, ErrCheckpointExists) {
+		t.Errorf("Expected ErrCheckpointExists, got %v", err)
+	}
+	if _, err := os.Stat(leftover + ".tmp"); err != nil {
+		t.Errorf("Expected the leftover directory to be kept: %v", err)
+	}
+
+	// the server only takes names and writes them under CheckpointDir
+	post := func(name string) int {
+		r := httptest.NewRequest(http.MethodPost, "/admin/checkpoint", strings.NewReader(url.Values{"name": {name}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		db.HandleCheckpoint(w, r)
+		return w.Code
+	}
+	if code := post("daily"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without CheckpointDir, got %d", code)
+	}
+	db.options.CheckpointDir = filepath.Join(t.TempDir(), "checkpoints")
+	if code := post("../escape"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a path, got %d", code)
+	}
+	if code := post("daily"); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(db.options.CheckpointDir, "daily", "MANIFEST")); err != nil {
+		t.Errorf("Expected a checkpoint under CheckpointDir: %v", err)
+	}
+}
+
+func TestBackupEngine(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MemTableSize = 50
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	engine, err := OpenBackupEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	set := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	set(0, 120)
+	first, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	set(120, 140)
+	second, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first.NewBytes != first.Size || second.NewBytes == 0 || second.NewBytes >= second.Size {
+		t.Errorf("Expected the second backup to only copy new files, got %d of %d bytes", second.NewBytes, second.Size)
+	}
+	backups, err := engine.ListBackups()
+	if err != nil || len(backups) != 2 || backups[0].ID != first.ID || backups[1].ID != second.ID {
+		t.Fatalf("Unexpected backups %+v (%v)", backups, err)
+	}
+
+	check := func(id, keys int) {
+		target := filepath.Join(t.TempDir(), "restore")
+		if err := engine.RestoreBackup(id, target); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		restored, err := Open(target, opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer restored.Close()
+		for i := 0; i < 140; i++ {
+			v, err := restored.Get([]byte("key" + strconv.Itoa(i)))
+			if want := i < keys; err != nil || (v != nil) != want {
+				t.Fatalf("Backup %d: expected key%d present=%v, got %q (%v)", id, i, want, v, err)
+			}
+		}
+	}
+	check(first.ID, 120)
+	check(second.ID, 140)
+
+	if err := engine.PurgeOldBackups(1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := engine.RestoreBackup(first.ID, filepath.Join(t.TempDir(), "restore")); !errors.Is(err, ErrBackupNotFound) {
+		t.Errorf("Expected ErrBackupNotFound, got %v", err)
+	}
+	check(second.ID, 140)
+
+	// a purge cannot run while another engine holds the backup directory
+	other, err := OpenBackupEngine(engine.directory)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release, err := other.lock()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := engine.PurgeOldBackups(0); !errors.Is(err, ErrBackupLocked) {
+		t.Errorf("Expected ErrBackupLocked, got %v", err)
+	}
+	release()
+
+	// a damaged backup file is detected on restore
+	hash := second.Families[0].Files[0].Hash
+	path := engine.objectPath(hash)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	target := filepath.Join(t.TempDir(), "restore")
+	if err := engine.RestoreBackup(second.ID, target); !errors.Is(err, ErrCorruption) {
+		t.Errorf("Expected ErrCorruption, got %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("Expected no restored directory after a failed restore")
+	}
+}
+
+func TestPointInTimeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	opts := DefaultOptions()
+	opts.MemTableSize = 20
+	opts.WALArchiveDir = archive
+	db, err := Open(filepath.Join(dir, "db"), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	base := filepath.Join(dir, "base")
+	if err := db.Checkpoint(base); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 50; i < 100; i++ {
+		if err := db.Set([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	before := db.LastSequence()
+	cut := time.Now()
+	time.Sleep(time.Millisecond)
+	// the accident: every key is deleted
+	for i := 0; i < 100; i++ {
+		if _, err := db.Del([]byte("key" + strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if before != 100 || db.LastSequence() != 200 {
+		t.Fatalf("Expected sequences 100 and 200, got %d and %d", before, db.LastSequence())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	check := func(target RecoveryTarget, keys int) {
+		recovered := filepath.Join(t.TempDir(), "recovered")
+		report, err := RecoverToPoint(base, archive, recovered, target, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if report.BaseSequence != 50 || report.LastSequence != before {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		db, err := Open(recovered, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer db.Close()
+		for i := 0; i < 100; i++ {
+			v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+			if err != nil || (v != nil) != (i < keys) {
+				t.Fatalf("Expected key%d present=%v, got %q (%v)", i, i < keys, v, err)
+			}
+		}
+		if db.LastSequence() != before {
+			t.Errorf("Expected the recovered database to continue from %d, got %d", before, db.LastSequence())
+		}
+	}
+	check(RecoveryTarget{Sequence: before}, 100)
+	target, err := ParseRecoveryTarget(cut.Format(time.RFC3339Nano))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check(target, 100)
+
+	if _, err := RecoverToPoint(base, archive, filepath.Join(t.TempDir(), "recovered"), RecoveryTarget{Sequence: 300}, nil); err == nil {
+		t.Errorf("Expected an error for a target past the archive")
+	}
+	segments, _ := filepath.Glob(filepath.Join(archive, "*.wal"))
+	if len(segments) < 4 {
+		t.Fatalf("Expected several archived segments, got %d", len(segments))
+	}
+	if err := os.Remove(segments[len(segments)-2]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := RecoverToPoint(base, archive, filepath.Join(t.TempDir(), "recovered"), RecoveryTarget{}, nil); err == nil || !strings.Contains(err.Error(), "Missing WAL records") {
+		t.Errorf("Expected a missing segment error, got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemTableSize = 30
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("user:%03d", i), "value"+strconv.Itoa(i)
+		if err := db.Set([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		want[key] = value
+	}
+	// overwrites and deletes spread over the SST files and the MemTable
+	for i := 0; i < 100; i += 10 {
+		key := fmt.Sprintf("user:%03d", i)
+		db.Del([]byte(key))
+		delete(want, key)
+		db.Set([]byte(fmt.Sprintf("user:%03d", i+1)), []byte("updated"))
+		want[fmt.Sprintf("user:%03d", i+1)] = "updated"
+	}
+	binary := string([]byte{0xff, 0x00, 0xfe})
+	db.Set([]byte("bin:1"), []byte(binary))
+	want["bin:1"] = binary
+
+	for _, format := range []string{FormatNDJSON, FormatCSV} {
+		var buf bytes.Buffer
+		n, err := Export(db.families[DefaultColumnFamily], &buf, ExportOptions{Format: format}, nil)
+		if err != nil || n != len(want) {
+			t.Fatalf("%s: expected %d records, got %d (%v)", format, len(want), n, err)
+		}
+		if format == FormatNDJSON && !strings.Contains(buf.String(), `"encoding":"base64"`) {
+			t.Errorf("Expected the binary value to be written in base64")
+		}
+		target, err := Open(t.TempDir(), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var batches int
+		n, err = Import(target.families[DefaultColumnFamily], &buf, format, 7, func(ImportProgress) { batches++ })
+		if err != nil || n != len(want) || batches != (len(want)+6)/7 {
+			t.Fatalf("%s: expected %d records in %d batches, got %d in %d (%v)", format, len(want), (len(want)+6)/7, n, batches, err)
+		}
+		for key, value := range want {
+			v, err := target.Get([]byte(key))
+			if err != nil || string(v) != value {
+				t.Errorf("%s: expected %q for %s, got %q (%v)", format, value, key, v, err)
+			}
+		}
+		target.Close()
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(db.families[DefaultColumnFamily], &buf, ExportOptions{Prefix: []byte("user:01"), End: []byte("user:015")}, nil)
+	if err != nil || n != 4 || !strings.HasPrefix(buf.String(), `{"key":"user:011"`) {
+		t.Errorf("Expected user:011 to user:014, got %d records (%v):\n%s", n, err, buf.String())
+	}
+	if _, err := Import(db.families[DefaultColumnFamily], strings.NewReader("{\"key\":\"a\",\"value\":\"b\"}\nnot json\n"), FormatNDJSON, 10, nil); err == nil {
+		t.Errorf("Expected an error for a malformed record")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemTableSize = 8
+	opts.CompactionTrigger = 3
+	opts.BlobThreshold = 32
+	db, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	want := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		key, value := fmt.Sprintf("key%02d", i), "value"+strconv.Itoa(i)
+		if i%7 == 0 {
+			value = strings.Repeat(value, 8)
+		}
+		db.Set([]byte(key), []byte(value))
+		want[key] = value
+	}
+	for i := 0; i < 60; i += 5 {
+		key := fmt.Sprintf("key%02d", i)
+		db.Del([]byte(key))
+		delete(want, key)
+	}
+	cf := db.families[DefaultColumnFamily]
+	it, err := cf.NewIterator([]byte("key10"), []byte("key50"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer it.Close()
+	first, _, err := it.Next()
+	if err != nil || string(first) != "key11" {
+		t.Fatalf("Expected key11, got %q (%v)", first, err)
+	}
+	// the iterator does not hold the lock and keeps its view while the family is rewritten
+	for i := 0; i < 60; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(strings.Repeat("new", 20))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	got := []string{string(first)}
+	for {
+		key, value, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if want[string(key)] != string(value) {
+			t.Errorf("Expected %q for %s, got %q", want[string(key)], key, value)
+		}
+		got = append(got, string(key))
+	}
+	var expected []string
+	for i := 10; i < 50; i++ {
+		if key := fmt.Sprintf("key%02d", i); want[key] != "" {
+			expected = append(expected, key)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestIngestFiles(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db.Set([]byte("a:old"), []byte("flushed"))
+	db.Sync()
+	db.mu.Lock()
+	db.flush()
+	db.mu.Unlock()
+	db.Set([]byte("b:0005"), []byte("memtable"))
+
+	build := func(name, prefix string, from, to int, del string) string {
+		path := filepath.Join(dir, name)
+		w, err := NewSSTWriter(path, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		entries := to - from
+		if del != "" {
+			entries++
+			if err := w.Delete([]byte(del)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		for i := from; i < to; i++ {
+			if err := w.Put([]byte(fmt.Sprintf("%s:%04d", prefix, i)), []byte("ingested"+strconv.Itoa(i))); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		info, err := w.Finish()
+		if err != nil || info.Entries != entries {
+			t.Fatalf("Unexpected file %+v (%v)", info, err)
+		}
+		return path
+	}
+	first := build("first.sst", "b", 0, 1000, "a:old")
+	second := build("second.sst", "c", 0, 1000, "")
+	overlapping := build("overlapping.sst", "b", 999, 1001, "")
+
+	w, _ := NewSSTWriter(filepath.Join(dir, "unordered.sst"), nil)
+	w.Put([]byte("z"), []byte("1"))
+	if err := w.Put([]byte("y"), []byte("1")); err == nil {
+		t.Errorf("Expected an error for keys out of order")
+	}
+	w.Abort()
+
+	if err := db.IngestFiles([]string{first, overlapping}); !errors.Is(err, ErrOverlappingFiles) {
+		t.Errorf("Expected ErrOverlappingFiles, got %v", err)
+	}
+	if err := db.IngestFiles([]string{first, second}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check := func() {
+		for _, key := range []string{"b:0005", "b:0999", "c:0000"} {
+			v, err := db.Get([]byte(key))
+			if err != nil || !strings.HasPrefix(string(v), "ingested") {
+				t.Errorf("Expected the ingested value of %s, got %q (%v)", key, v, err)
+			}
+		}
+		if v, err := db.Get([]byte("a:old")); err != nil || v != nil {
+			t.Errorf("Expected a:old to be deleted by the ingested tombstone, got %q (%v)", v, err)
+		}
+	}
+	check()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the ingested files are links, the originals can go
+	os.Remove(first)
+	os.Remove(second)
+	db, err = Open(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestBlobFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MemTableSize = 10
+	opts.CompactionTrigger = 3
+	opts.BlobThreshold = 1000
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	doc := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("doc%d-v%d|", i, version)), 2000)
+	}
+	want := make(map[string][]byte)
+	for version := 0; version < 4; version++ {
+		for i := 0; i < 30; i++ {
+			// a few documents are never rewritten, their blob file keeps live values
+			if version > 0 && i < 3 {
+				continue
+			}
+			key := "doc" + strconv.Itoa(i)
+			if err := db.Set([]byte(key), doc(i, version)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			want[key] = doc(i, version)
+		}
+	}
+	db.Set([]byte("small"), []byte("inline"))
+	want["small"] = []byte("inline")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var live int64
+	for _, v := range want {
+		live += int64(len(v))
+	}
+	size := func(pattern string) int64 {
+		paths, _ := filepath.Glob(filepath.Join(dir, pattern))
+		var total int64
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				total += info.Size()
+			}
+		}
+		return total
+	}
+	if sst := size("*.sst"); sst > live/20 {
+		t.Errorf("Expected the SST files to hold pointers only, got %d bytes for %d bytes of values", sst, live)
+	}
+	// 4 versions were written, garbage collection keeps the blob files close to the live data
+	if blobs := size("*.blob"); blobs < live || blobs > 2*live {
+		t.Errorf("Expected between %d and %d bytes of blob files, got %d", live, 2*live, blobs)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for key, value := range want {
+		v, err := db.Get([]byte(key))
+		if err != nil || !bytes.Equal(v, value) {
+			t.Fatalf("Unexpected value for %s: %d bytes (%v)", key, len(v), err)
+		}
+	}
+	count := 0
+	db.families[DefaultColumnFamily].Scan(nil, nil, func(key, value []byte) error {
+		if !bytes.Equal(value, want[string(key)]) {
+			t.Errorf("Unexpected scanned value for %s", key)
+		}
+		count++
+		return nil
+	})
+	if count != len(want) {
+		t.Errorf("Expected %d scanned keys, got %d", len(want), count)
+	}
+
+	// checkpoints carry the blob files
+	target := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(target); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkpoint, err := Open(target, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v, err := checkpoint.Get([]byte("doc5")); err != nil || !bytes.Equal(v, want["doc5"]) {
+		t.Errorf("Unexpected value in the checkpoint: %d bytes (%v)", len(v), err)
+	}
+	checkpoint.Close()
+
+	// a damaged value is detected by its checksum, the newest blob file ends with a live one
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.blob"))
+	data, _ := ioutil.ReadFile(paths[len(paths)-1])
+	data[len(data)-10] ^= 0xff
+	ioutil.WriteFile(paths[len(paths)-1], data, 0644)
+	corrupted := 0
+	for key := range want {
+		if _, err := db.Get([]byte(key)); errors.Is(err, ErrCorruption) {
+			corrupted++
+		}
+	}
+	if corrupted != 1 {
+		t.Errorf("Expected one corrupted value, got %d", corrupted)
+	}
+
+	// without compactions, flushes and Open remove the blob files no live entry refers to
+	opts = DefaultOptions()
+	opts.MemTableSize = 10
+	opts.BlobThreshold = 1000
+	dir = t.TempDir()
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for version := 0; version < 4; version++ {
+		for i := 0; i < 11; i++ {
+			if err := db.Set([]byte("doc"+strconv.Itoa(i)), doc(i, version)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	if err := db.SetStream([]byte("empty"), strings.NewReader(""), 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 11; i++ {
+		db.Del([]byte("doc" + strconv.Itoa(i)))
+	}
+	simulateCrash(db)
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	if blobs := db.FileManager.blobs; len(blobs) != 1 {
+		t.Errorf("Expected only the blob file of the empty stream, got %d", len(blobs))
+	}
+	if v, err := db.Get([]byte("empty")); err != nil || v == nil || len(v) != 0 {
+		t.Errorf("Expected an empty value, got %q (%v)", v, err)
+	}
+
+	// blob files stay registered until a manifest without them is saved
+	fs := NewFaultFS()
+	opts.FS = fs
+	swept, err := Open(filepath.Join(t.TempDir(), "swept"), opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer swept.Close()
+	// writes a blob file and flushes the deletes of all its values
+	round := func(fail bool) {
+		for i := 0; i < 10; i++ {
+			if err := swept.Set([]byte("doc"+strconv.Itoa(i)), doc(i, 0)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		if err := swept.flush(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			swept.Del([]byte("doc" + strconv.Itoa(i)))
+		}
+		if fail {
+			// the flush saves the manifest, then the sweep fails to
+			fs.FailNth(FaultRename, 2)
+		}
+		if err := swept.flush(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	round(true)
+	dead := swept.FileManager.blobs
+	if len(dead) == 0 || len(swept.FileManager.blobs) != len(dead) {
+		t.Errorf("Expected %d blob files to stay registered, got %d", len(dead), len(swept.FileManager.blobs))
+	}
+	swept.sweepBlobs()
+	if len(swept.FileManager.blobs) != 0 {
+		t.Errorf("Expected no blob files, got %d", len(swept.FileManager.blobs))
+	}
+	for _, meta := range dead {
+		if _, err := fs.Stat(swept.FileManager.blobPath(meta.Number)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", meta.name(), err)
+		}
+	}
+	// flushes only sweep once the SST files doubled since the last sweep, Open always does
+	round(false)
+	if files, blobs := len(swept.FileManager.files), len(swept.FileManager.blobs); files != 4 || blobs != 0 {
+		t.Errorf("Expected 4 SST files and no blob file, got %d and %d", files, blobs)
+	}
+	round(false)
+	if blobs := len(swept.FileManager.blobs); blobs != 1 {
+		t.Errorf("Expected the sweep to wait for 8 SST files, got %d blob files", blobs)
+	}
+	if err := swept.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	swept, err = Open(swept.directory, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer swept.Close()
+	if blobs := len(swept.FileManager.blobs); blobs != 0 {
+		t.Errorf("Expected Open to sweep, got %d blob files", blobs)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.MemTableSize = 4
+	opts.CompactionTrigger = 2
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// far past MaxEntrySize, the value only ever exists as a stream
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("stream%d|", i)), 300000)
+	}
+	read := func(db *FileDB, key string) []byte {
+		t.Helper()
+		r, err := db.GetStream([]byte(key))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if size := r.Size(); size != int64(len(data)) {
+			t.Errorf("Expected a size of %d, got %d", len(data), size)
+		}
+		return data
+	}
+	for i := 0; i < 3; i++ {
+		v := value(i)
+		if err := db.SetStream([]byte(fmt.Sprintf("big%d", i)), bytes.NewReader(v), int64(len(v))); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := db.SetStream([]byte("short"), strings.NewReader("abc"), 10); err == nil {
+		t.Errorf("Expected an error for a short stream")
+	}
+	if _, err := db.GetStream([]byte("short")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	db.Set([]byte("small"), []byte("inline"))
+	if got := read(db, "small"); string(got) != "inline" {
+		t.Errorf("Unexpected inline value %q", got)
+	}
+	if got := read(db, "big1"); !bytes.Equal(got, value(1)) {
+		t.Errorf("Unexpected streamed value of %d bytes", len(got))
+	}
+	if got, err := db.Get([]byte("big2")); err != nil || !bytes.Equal(got, value(2)) {
+		t.Errorf("Unexpected value of %d bytes (%v)", len(got), err)
+	}
+
+	// flushes and compactions keep the blob files of streamed values
+	for i := 0; i < 20; i++ {
+		db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+	db.Del([]byte("big0"))
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 1; i < 3; i++ {
+		if got := read(db, fmt.Sprintf("big%d", i)); !bytes.Equal(got, value(i)) {
+			t.Errorf("Unexpected value of %d bytes for big%d after reopening", len(got), i)
+		}
+	}
+	if _, err := db.GetStream([]byte("big0")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a deleted key, got %v", err)
+	}
+
+	// raw bodies over HTTP
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/family" {
+			db.HandleFamily(w, r)
+		} else if r.Method == http.MethodPut {
+			db.HandleSet(w, r)
+		} else {
+			db.HandleGet(w, r)
+		}
+	}))
+	defer server.Close()
+	put := func() int {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/set?key=upload&ns=files", bytes.NewReader(value(7)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// writes do not create namespaces, the admin endpoint does
+	if status := put(); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown namespace, got %d", status)
+	}
+	for _, want := range []int{http.StatusCreated, http.StatusConflict} {
+		resp, err := http.PostForm(server.URL+"/admin/family", url.Values{"name": {"files"}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("Expected status %d, got %d", want, resp.StatusCode)
+		}
+	}
+	if status := put(); status != http.StatusOK {
+		t.Fatalf("Unexpected status %d", status)
+	}
+	resp, err := http.Get(server.URL + "/get?key=upload&ns=files&raw=1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.ContentLength != int64(len(value(7))) || !bytes.Equal(body, value(7)) {
+		t.Errorf("Unexpected response: length %d, %d bytes (%v)", resp.ContentLength, len(body), err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	key := func(b byte) string {
+		return strings.Repeat(fmt.Sprintf("%02x", b), 32)
+	}
+	keys, err := ParseKeys("1:" + key(1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.MemTableSize = 20
+	opts.CompactionTrigger = 2
+	opts.KeyProvider = keys
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 70; i++ {
+		db.Set([]byte(fmt.Sprintf("customer%03d", i)), []byte(fmt.Sprintf("secret-%d", i)))
+	}
+	plaintext := func(dir string) []string {
+		var found []string
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, _ := ioutil.ReadFile(path)
+			if bytes.Contains(data, []byte("secret-")) || bytes.Contains(data, []byte("customer")) {
+				found = append(found, path)
+			}
+			return nil
+		})
+		return found
+	}
+	// the WAL holds the last writes, the SST files and the manifest the others
+	if found := plaintext(dir); len(found) != 0 {
+		t.Errorf("Expected no plain text on disk, found some in %v", found)
+	}
+	copyDir := filepath.Join(t.TempDir(), "copy")
+	os.MkdirAll(copyDir, 0755)
+	for _, name := range []string{"log", manifestName} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		ioutil.WriteFile(filepath.Join(copyDir, name), data, 0644)
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	for _, path := range paths {
+		data, _ := ioutil.ReadFile(path)
+		ioutil.WriteFile(filepath.Join(copyDir, filepath.Base(path)), data, 0644)
+	}
+	if err := db.SetStream([]byte("stream"), strings.NewReader("abc"), 3); err == nil {
+		t.Errorf("Expected streamed values to be rejected with encryption")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the encrypted WAL of the copy is replayed
+	copied, err := Open(copyDir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v, err := copied.Get([]byte("customer069")); err != nil || string(v) != "secret-69" {
+		t.Errorf("Unexpected value %q (%v)", v, err)
+	}
+	copied.Close()
+
+	if _, err := Open(dir, nil); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("Expected ErrMissingKey without keys, got %v", err)
+	}
+	wrong, _ := ParseKeys("1:" + key(9))
+	wrongOpts := *opts
+	wrongOpts.KeyProvider = wrong
+	if _, err := Open(dir, &wrongOpts); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey, got %v", err)
+	}
+
+	// key 2 becomes active, compactions rewrite the files with it
+	fetched := 0
+	opts.KeyProvider = NewCallbackKeyProvider(2, func(id uint32) ([]byte, error) {
+		fetched++
+		if id > 2 {
+			return nil, errors.New("unknown key")
+		}
+		return hex.DecodeString(key(byte(id)))
+	})
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 70; i++ {
+		db.Set([]byte(fmt.Sprintf("customer%03d", i)), []byte(fmt.Sprintf("secret-v2-%d", i)))
+	}
+	if v, err := db.Get([]byte("customer042")); err != nil || string(v) != "secret-v2-42" {
+		t.Errorf("Unexpected value %q (%v)", v, err)
+	}
+	for _, meta := range db.FileManager.files {
+		r, err := db.FileManager.reader(meta)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if r.header.KeyID != 2 {
+			t.Errorf("Expected %s to be encrypted with key 2, got key %d", meta.Name, r.header.KeyID)
+		}
+		r.Close()
+	}
+	if fetched != 2 {
+		t.Errorf("Expected each key to be fetched once, got %d fetches", fetched)
+	}
+	if found := plaintext(dir); len(found) != 0 {
+		t.Errorf("Expected no plain text on disk, found some in %v", found)
+	}
+
+	// backups need the keys, and restore an encrypted manifest
+	plain, err := OpenBackupEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := plain.CreateBackup(db); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("Expected ErrMissingKey without keys, got %v", err)
+	}
+	engine, err := OpenBackupEngineWithKeys(t.TempDir(), OSFS{}, opts.KeyProvider)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := engine.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	target := filepath.Join(t.TempDir(), "restore")
+	if err := engine.RestoreBackup(info.ID, target); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found := plaintext(target); len(found) != 0 {
+		t.Errorf("Expected no plain text in the restored database, found some in %v", found)
+	}
+	if found := plaintext(engine.directory); len(found) != 0 {
+		t.Errorf("Expected no plain text in the backups, found some in %v", found)
+	}
+	if backups, err := engine.ListBackups(); err != nil || len(backups) != 1 || backups[0].Families[0].Files[0].Meta.Smallest == nil {
+		t.Errorf("Unexpected backups %+v (%v)", backups, err)
+	}
+	restored, err := Open(target, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer restored.Close()
+	if v, err := restored.Get([]byte("customer042")); err != nil || string(v) != "secret-v2-42" {
+		t.Errorf("Unexpected value %q (%v)", v, err)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "db")
+	mem := NewMemFS()
+	opts := DefaultOptions()
+	opts.MemTableSize = 20
+	opts.CompactionTrigger = 2
+	opts.BlobThreshold = 64
+	opts.FS = mem
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := Open(dir, opts); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("Expected ErrDatabaseLocked, got %v", err)
+	}
+	users, err := db.CreateFamily("users", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+		users.Set([]byte(fmt.Sprintf("user%03d", i)), []byte(strings.Repeat("u", 100)))
+	}
+	if err := db.Checkpoint(filepath.Join(root, "checkpoint")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	engine, err := OpenBackupEngineWithFS(filepath.Join(root, "backups"), mem)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := engine.CreateBackup(db); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db.Set([]byte("late"), []byte("in the WAL"))
+	simulateCrash(db)
+
+	// nothing reached the disk
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Fatalf("Expected nothing on disk, found %d entries", len(entries))
+	}
+	if files, err := mem.ReadDir(dir); err != nil || len(files) == 0 {
+		t.Fatalf("Expected the database in memory, got %d files (%v)", len(files), err)
+	}
+	if err := engine.RestoreBackup(1, filepath.Join(root, "restored")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, path := range []string{dir, filepath.Join(root, "checkpoint"), filepath.Join(root, "restored")} {
+		db, err := Open(path, opts)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+		if v, err := db.Get([]byte("key042")); err != nil || string(v) != "value42" {
+			t.Errorf("%s: unexpected value %q (%v)", path, v, err)
+		}
+		users, err := db.Family("users")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+		if v, err := users.Get([]byte("user099")); err != nil || len(v) != 100 {
+			t.Errorf("%s: unexpected value of %d bytes (%v)", path, len(v), err)
+		}
+		_, err = db.Get([]byte("late"))
+		if path == dir && err != nil {
+			t.Errorf("Expected the WAL to be replayed, got %v", err)
+		}
+		db.Close()
+	}
+
+	// an open file keeps its content once removed, like on Unix
+	file, err := mem.Create(filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	file.Write([]byte("content"))
+	if err := mem.Remove(file.Name()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf := make([]byte, 7)
+	if _, err := file.ReadAt(buf, 0); err != nil || string(buf) != "content" {
+		t.Errorf("Unexpected content %q (%v)", buf, err)
+	}
+	if _, err := mem.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected a removed file to be gone, got %v", err)
+	}
+	file.Close()
+}
+
+// crashModel tracks the writes of a crash test run to tell which values a key may hold once
+// the database recovers: the value of its last write known to be durable, or the value of any
+// later write or failed one.
+type crashModel struct {
+	baseline map[string]string // content found by the last recovery, family/key to value
+	ops      []crashOp
+	durable  int // acknowledged operations before this index are durable
+}
+
+type crashOp struct {
+	key   string
+	value string // empty for a deletion
+	acked bool
+}
+
+func (m *crashModel) allowed(key string) map[string]bool {
+	base := m.baseline[key]
+	var later []string
+	for i, op := range m.ops {
+		if op.key != key {
+			continue
+		}
+		if op.acked && i < m.durable {
+			base, later = op.value, nil
+		} else {
+			later = append(later, op.value)
+		}
+	}
+	allowed := map[string]bool{base: true}
+	for _, v := range later {
+		allowed[v] = true
+	}
+	return allowed
+}
+
+// verify checks the content of a recovered database against the model, which then starts over from it.
+func (m *crashModel) verify(db *FileDB, families []string) error {
+	content := make(map[string]string)
+	for _, name := range families {
+		cf, err := db.Family(name)
+		if err != nil {
+			return err
+		}
+		err = cf.Scan(nil, nil, func(key, value []byte) error {
+			content[name+"/"+string(key)] = string(value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	keys := make(map[string]bool)
+	for key := range content {
+		keys[key] = true
+	}
+	for key := range m.baseline {
+		keys[key] = true
+	}
+	for _, op := range m.ops {
+		keys[op.key] = true
+	}
+	for key := range keys {
+		if allowed := m.allowed(key); !allowed[content[key]] {
+			return fmt.Errorf("%s holds %q, expected one of %q", key, content[key], sortedKeysOfSet(allowed))
+		}
+	}
+	m.baseline, m.ops, m.durable = content, nil, 0
+	return nil
+}
+
+func sortedKeysOfSet(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runCrashTest writes random batches to a database on a FaultFS, makes its filesystem fail
+// or crash at random points, then checks that the recovered database holds every durable
+// write and nothing that was never written.
+func runCrashTest(seed int64, mode SyncMode) error {
+	rng := rand.New(rand.NewSource(seed))
+	fs := NewFaultFS()
+	opts := DefaultOptions()
+	opts.FS = fs
+	opts.SyncMode = mode
+	opts.MemTableSize = 8
+	opts.CompactionTrigger = 3
+	opts.MaxFileSize = 1024
+	opts.BlobThreshold = 64
+	families := []string{DefaultColumnFamily, "users"}
+	db, err := Open("db", opts)
+	if err != nil {
+		return err
+	}
+	if _, err := db.CreateFamily("users", nil); err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	model := &crashModel{baseline: make(map[string]string)}
+	written := 0
+	for round := 0; round < 6; round++ {
+		db, err := Open("db", opts)
+		if err != nil {
+			return fmt.Errorf("round %d: open: %w", round, err)
+		}
+		if err := model.verify(db, families); err != nil {
+			return fmt.Errorf("round %d: %w", round, err)
+		}
+		switch rng.Intn(3) {
+		case 0:
+			fs.CrashAfter(rng.Intn(400))
+		case 1:
+			fs.FailNth(FaultOp(rng.Intn(3)), 1+rng.Intn(60))
+		}
+		for i := 0; i < 120 && !fs.Crashed(); i++ {
+			if rng.Intn(10) == 0 {
+				if db.Sync() == nil {
+					model.durable = len(model.ops)
+				}
+				continue
+			}
+			b := NewWriteBatch()
+			start := len(model.ops)
+			for n := 1 + rng.Intn(3); n > 0; n-- {
+				family := families[rng.Intn(len(families))]
+				key := fmt.Sprintf("key%02d", rng.Intn(30))
+				written++
+				value := fmt.Sprintf("value%d", written)
+				if rng.Intn(4) == 0 {
+					value += strings.Repeat("-", 64)
+				}
+				if rng.Intn(5) == 0 {
+					b.Del(family, []byte(key))
+					value = ""
+				} else {
+					b.Set(family, []byte(key), []byte(value))
+				}
+				model.ops = append(model.ops, crashOp{key: family + "/" + key, value: value})
+			}
+			if db.Write(b) != nil {
+				continue
+			}
+			for j := start; j < len(model.ops); j++ {
+				model.ops[j].acked = true
+			}
+			if mode == SyncAlways {
+				model.durable = len(model.ops)
+			}
+		}
+		if rng.Intn(4) == 0 && db.Close() == nil {
+			model.durable = len(model.ops)
+		}
+		fs.Crash(rng)
+	}
+	return nil
+}
+
+func TestCrashConsistency(t *testing.T) {
+	seeds := int64(60)
+	if testing.Short() {
+		seeds = 10
+	}
+	for _, mode := range []SyncMode{SyncFlush, SyncAlways} {
+		for seed := int64(1); seed <= seeds; seed++ {
+			if err := runCrashTest(seed, mode); err != nil {
+				t.Errorf("Seed %d with sync mode %s: %v", seed, mode, err)
+			}
+		}
+	}
+}
@@ -3,14 +3,14 @@ module github.com/um6p/kvstore
 go 1.21.3
 
 require (
+	github.com/gofrs/flock v0.8.1
 	github.com/wk8/go-ordered-map v1.0.0
 	golang.org/x/text v0.14.0
 )
 
 require (
-	github.com/gofrs/flock v0.8.1 // indirect
 	github.com/joho/godotenv v1.5.1
 	github.com/theckman/go-flock v0.8.1 // indirect
 	github.com/umpc/go-sortedmap v0.0.0-20180422175548-64ab94c482f4 // indirect
-	golang.org/x/sys v0.14.0 // indirect
+	golang.org/x/sys v0.14.0
 )
@@ -2,13 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -41,8 +48,6 @@ type DB interface {
 	Del(key []byte) ([]byte, error)
 }
 
-
-
 type memDB struct {
 	values map[string][]byte
 }
@@ -162,14 +167,34 @@ func (re *Repl) Start() {
 	}
 }
 
-
 /*
 	Program Entry point Main:
 	interface DB: needs Reader,Writer
-	FileManager: read write 
-	once instantiated : the FileManager look into the file directory and loads the last file 
+	FileManager: read write
+	once instantiated : the FileManager look into the file directory and loads the last file
 */
 
+// namespace resolves the column family named by the ns parameter, the default family when it is absent.
+// Unknown namespaces are reported as not found, they are created through /admin/family.
+func (db *FileDB) namespace(w http.ResponseWriter, r *http.Request) *ColumnFamily {
+	ns := r.URL.Query().Get("ns")
+	if ns == "" && r.Method == http.MethodPost {
+		ns = r.FormValue("ns")
+	}
+	if ns == "" {
+		ns = DefaultColumnFamily
+	}
+	cf, err := db.Family(ns)
+	if err == ErrColumnFamilyNotFound {
+		http.Error(w, "Namespace not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return cf
+}
 
 func (db *FileDB) HandleGet(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
@@ -177,7 +202,15 @@ func (db *FileDB) HandleGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Key parameter is missing", http.StatusBadRequest)
 		return
 	}
-	value,err:= db.Get([]byte(key))
+	cf := db.namespace(w, r)
+	if cf == nil {
+		return
+	}
+	if r.URL.Query().Get("raw") != "" {
+		db.streamValue(w, cf, key)
+		return
+	}
+	value, err := cf.Get([]byte(key))
 	if err != nil {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
@@ -189,7 +222,31 @@ func (db *FileDB) HandleGet(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "GET result for key %s: %s", key, value)
 }
 
+// streamValue writes the value of key as the whole response body, with its Content-Length.
+func (db *FileDB) streamValue(w http.ResponseWriter, cf *ColumnFamily, key string) {
+	value, err := cf.GetStream([]byte(key))
+	if err == ErrKeyNotFound {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading key", http.StatusInternalServerError)
+		return
+	}
+	defer value.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(value.Size(), 10))
+	if _, err := io.Copy(w, value); err != nil {
+		// the status is sent already, the client sees a short body
+		log.Printf("Error streaming key %s: %v", key, err)
+	}
+}
+
 func (db *FileDB) HandleSet(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		db.handlePut(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -200,7 +257,11 @@ func (db *FileDB) HandleSet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Key or value parameter is missing", http.StatusBadRequest)
 		return
 	}
-	err := db.Set([]byte(key), []byte(value))
+	cf := db.namespace(w, r)
+	if cf == nil {
+		return
+	}
+	err := cf.Set([]byte(key), []byte(value))
 	if err != nil {
 		http.Error(w, "Error setting key", http.StatusInternalServerError)
 		return
@@ -209,13 +270,44 @@ func (db *FileDB) HandleSet(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "SET success for key %s", key)
 }
 
+// handlePut stores the raw request body as the value of key, streamed to a blob file.
+func (db *FileDB) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Key parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	cf := db.namespace(w, r)
+	if cf == nil {
+		return
+	}
+	err := cf.SetStream([]byte(key), r.Body, r.ContentLength)
+	if err == ErrValueTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error setting key", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "SET success for key %s", key)
+}
+
 func (db *FileDB) HandleDel(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	if key == "" {
 		http.Error(w, "Key parameter is missing", http.StatusBadRequest)
 		return
 	}
-	v,err:=db.Del([]byte(key))
+	cf := db.namespace(w, r)
+	if cf == nil {
+		return
+	}
+	v, err := cf.Del([]byte(key))
 	if err != nil {
 		http.Error(w, "Error deleting key", http.StatusInternalServerError)
 		return
@@ -227,55 +319,154 @@ func (db *FileDB) HandleDel(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", v)
 }
 
+// HandleHealth reports the corruption status, 503 once corruption has been found.
+func (db *FileDB) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	status := db.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
 
-func main() {
-	err := godotenv.Load()
-	if err != nil {
-		fmt.Println("Error loading .env file")
+// commands are the subcommands of lentadb, without one the server is started.
+var commands = map[string]func(args []string) int{
+	"repair":     repairCommand,
+	"sst-dump":   sstDumpCommand,
+	"checkpoint": checkpointCommand,
+	"restore":    restoreCommand,
+	"export":     exportCommand,
+	"import":     importCommand,
+}
+
+// HandleCheckpoint writes a checkpoint of the database into the directory CheckpointDir/name.
+// Clients only choose the name, so they cannot write or remove anything outside CheckpointDir.
+func (db *FileDB) HandleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if db.options.CheckpointDir == "" {
+		http.Error(w, "Checkpoints are disabled, set CHECKPOINT_DIR", http.StatusForbidden)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Name parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if !familyNamePattern.MatchString(name) {
+		http.Error(w, "Invalid checkpoint name", http.StatusBadRequest)
+		return
+	}
+	if err := db.options.vfs().MkdirAll(db.options.CheckpointDir, 0755); err != nil {
+		http.Error(w, "Error creating the checkpoint directory", http.StatusInternalServerError)
+		return
+	}
+	err := db.Checkpoint(filepath.Join(db.options.CheckpointDir, name))
+	if errors.Is(err, ErrCheckpointExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
-	maxFileSize, _ := strconv.Atoi(os.Getenv("MAX_FILE_SIZE"))
-	FileManager, err := NewFileManager()
-	FileManager.MaxFileSize = int64(maxFileSize)
-	err = FileManager.init()
 	if err != nil {
-		fmt.Println(err)
+		http.Error(w, "Error writing checkpoint", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Checkpoint %s written", name)
+}
+
+// HandleFamily creates the column family named by the name parameter, with the default options.
+func (db *FileDB) HandleFamily(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Name parameter is missing", http.StatusBadRequest)
+		return
+	}
+	var readOnly *ReadOnlyError
+	_, err := db.CreateFamily(name, nil)
+	if err == ErrColumnFamilyExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.As(err, &readOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
-	header := NewSSTHeader()
-	FileManager.fileheader = header
-	db, err := NewFileDB(FileManager)
-	maxEntrySize, _ := strconv.Atoi(os.Getenv("MAX_ENTRY_SIZE"))
-	cacheSize, _ := strconv.Atoi(os.Getenv("CACHE_SIZE"))
-	fmt.Println("Cache Size: ", cacheSize)
-	db.MaxEntrySize = maxEntrySize
-	db.CacheSize = cacheSize
 	if err != nil {
-		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	FileManager.fileheader=header;
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Namespace %s created", name)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	err := godotenv.Load()
+	if err != nil {
+		fmt.Println("Error loading .env file")
+	}
+	directory, options, err := LoadOptions(os.Args[1:])
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(2)
 	}
+	fmt.Println("MemTable Size: ", options.MemTableSize)
+	db, err := Open(directory, options)
 	if err != nil {
 		fmt.Println(err)
-		return	
+		return
 	}
 	//repl := &Repl{
-		//db:  db,
-		//in:  os.Stdin,
-		//out: os.Stdout,
+	//db:  db,
+	//in:  os.Stdin,
+	//out: os.Stdout,
 	//}
 	//repl.Start()
 	http.HandleFunc("/get", db.HandleGet)
 	http.HandleFunc("/set", db.HandleSet)
 	http.HandleFunc("/del", db.HandleDel)
+	http.HandleFunc("/health", db.HandleHealth)
+	http.HandleFunc("/admin/checkpoint", db.HandleCheckpoint)
+	http.HandleFunc("/admin/family", db.HandleFamily)
 	port := 8080
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 	fmt.Printf("Server started on :%d\n", port)
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case err = <-serverErr:
+		fmt.Println(err)
+		exitCode = 1
+	case sig := <-stop:
+		fmt.Printf("Received %s, shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println("Error shutting down the server")
+			fmt.Println(err)
+		}
+	}
+	err = db.Close()
 	if err != nil {
+		fmt.Println("Error closing the database")
 		fmt.Println(err)
-		os.Exit(1)
+		exitCode = 1
 	}
-}
\ No newline at end of file
+	os.Exit(exitCode)
+}